@@ -0,0 +1,415 @@
+package mph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrCommitted is returned when a ShardedBuilder is used after Commit.
+var ErrCommitted = errors.New("mph: sharded table is already committed")
+
+var errIngested = errors.New("mph: ingestion is complete; call Commit")
+
+// A ShardedBuilder spreads keys over the shards of a sharded table and builds
+// them into a ShardedReader on Commit.
+type ShardedBuilder struct {
+	shardRouter
+	counts       []uint
+	mphDirPath   string
+	maxShardKeys uint // 0 if shards are never split
+	dedup        DedupMode
+	dedupMemory  int
+	duplicates   []uint      // dropped by Commit, per shard
+	writers      *tabWriters // nil once committed or closed
+	journal      *journal    // nil unless created with WithJournal
+	runs         *sortedRuns // nil unless created with WithSortedRuns
+	lock         *dirLock    // nil once committed or closed
+	inputOffset  uint64      // as of the last checkpoint
+	ingested     bool        // set by a Commit that a resumed builder continues
+	built        []*shardNode
+	committed    bool
+	closed       bool
+}
+
+// NewShardedBuilder returns a builder that spreads keys of length keyLen over
+// 2^prefBits shards, which are written to mphDirPath and built on Commit.
+// mphDirPath is created if needed and locked until Commit or Close; it must
+// not hold the files of another index unless WithOverwrite is given.
+// buffSzBytes bounds the total size of the shard write buffers, which are
+// split evenly among the shards, although every buffer holds at least 16
+// keys; a shard file is only written to when its buffer fills. With
+// WithSortedRuns, it bounds the run buffers instead.
+func NewShardedBuilder(
+	keyLen, prefBits, buffSzBytes int,
+	mphDirPath string,
+	opts ...ShardOption,
+) (*ShardedBuilder, error) {
+	if prefBits < 1 {
+		return nil, fmt.Errorf("prefixBits must be >= 1")
+	}
+	if prefBits > 32 {
+		return nil, fmt.Errorf("prefixBits must be <= 32 (memory constraints)")
+	}
+	so := newShardOptions(opts)
+	if so.shardFunc == nil {
+		return nil, fmt.Errorf("nil shard func")
+	}
+	// Route keys with the registered ShardFunc, which loaders will use.
+	shardFunc, err := lookupShardFunc(so.shardFunc.Name())
+	if err != nil {
+		return nil, err
+	}
+	if so.maxOpenFiles < 1 {
+		return nil, fmt.Errorf("max open files must be >= 1")
+	}
+	if so.maxShardKeys < 0 {
+		return nil, fmt.Errorf("max shard keys must be >= 0")
+	}
+	if so.maxShardKeys > 0 && so.shardFunc.Name() != ShardByPrefix.Name() {
+		return nil, fmt.Errorf("max shard keys requires shard func %q", ShardByPrefix.Name())
+	}
+	if so.dedupMemory < 1 {
+		return nil, fmt.Errorf("dedup memory must be >= 1")
+	}
+	if so.sortedRuns && so.journal {
+		return nil, fmt.Errorf("sorted runs cannot be journaled")
+	}
+	var lock *dirLock
+	if so.resume {
+		lock, err = lockDir(mphDirPath)
+	} else {
+		lock, err = prepareDir(mphDirPath, so.overwrite)
+	}
+	if err != nil {
+		return nil, err
+	}
+	numTabs := 1 << prefBits
+	b := &ShardedBuilder{
+		shardRouter: shardRouter{
+			keyLen:    keyLen,
+			prefBits:  prefBits,
+			shardFunc: shardFunc,
+		},
+		counts:       make([]uint, numTabs),
+		mphDirPath:   mphDirPath,
+		maxShardKeys: uint(so.maxShardKeys),
+		dedup:        so.dedup,
+		dedupMemory:  so.dedupMemory,
+		duplicates:   make([]uint, numTabs),
+		writers:      newTabWriters(mphDirPath, numTabs, keyLen, buffSzBytes, so.maxOpenFiles),
+		lock:         lock,
+	}
+	if so.sortedRuns {
+		b.runs = newSortedRuns(mphDirPath, keyLen, buffSzBytes)
+	}
+	if so.journal {
+		j, err := createJournal(mphDirPath)
+		if err != nil {
+			lock.unlock()
+			return nil, err
+		}
+		err = j.append(&journalRecord{
+			Kind:         journalStart,
+			KeyLen:       keyLen,
+			PrefBits:     prefBits,
+			ShardFunc:    shardFunc.Name(),
+			MaxShardKeys: b.maxShardKeys,
+			BuffSzBytes:  buffSzBytes,
+			Dedup:        b.dedup,
+			DedupMemory:  b.dedupMemory,
+		})
+		if err != nil {
+			j.close()
+			lock.unlock()
+			return nil, err
+		}
+		b.journal = j
+	}
+	return b, nil
+}
+
+// Put adds key to the shard it belongs to. Put may be called from several
+// goroutines at once, but not concurrently with Commit or Close.
+func (b *ShardedBuilder) Put(key []byte) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if b.ingested {
+		return errIngested
+	}
+	if len(key) != b.keyLen {
+		return fmt.Errorf("invalid key length %d, expected %d", len(key), b.keyLen)
+	}
+	shardIdx, err := b.topShardIndex(key)
+	if err != nil {
+		return err
+	}
+	if b.runs != nil {
+		return b.runs.put(shardIdx, key, &b.counts[shardIdx])
+	}
+	tblFile := b.writers.acquire(shardIdx)
+	defer tblFile.mu.Unlock()
+	if _, err = tblFile.Write(key); err != nil {
+		return err
+	}
+	b.counts[shardIdx]++
+	return nil
+}
+
+// putShardKeys copies count keys from src to shard shardIdx, which they must
+// belong to.
+func (b *ShardedBuilder) putShardKeys(shardIdx uint64, src io.Reader, count uint) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if b.ingested {
+		return errIngested
+	}
+	tblFile := b.writers.acquire(shardIdx)
+	defer tblFile.mu.Unlock()
+	n, err := io.CopyN(tblFile, src, int64(count)*int64(b.keyLen))
+	b.counts[shardIdx] += uint(n) / uint(b.keyLen)
+	return err
+}
+
+func (b *ShardedBuilder) checkOpen() error {
+	if b.closed {
+		return ErrClosed
+	}
+	if b.committed {
+		return ErrCommitted
+	}
+	return nil
+}
+
+// Commit builds the shards, at most parallelism at a time, or GOMAXPROCS at a
+// time if parallelism is not positive, splitting those that exceed the key
+// budget set with WithMaxShardKeys. It returns once all shards are built. The
+// builder cannot be used afterwards.
+//
+// Every loaded shard holds its keys file open. If b has more shards than
+// WithMaxOpenFiles allows open, or may have once they are split, the returned
+// reader loads its shards on first use and keeps at most that many loaded, as
+// with WithLazyLoading.
+//
+// If a shard fails to build or ctx is canceled, Commit removes the shard
+// files written by b, closes b and returns the error. Builders created with
+// WithJournal keep their files instead, so that the build can be resumed, and
+// remove the journal once Commit succeeds.
+func (b *ShardedBuilder) Commit(ctx context.Context, parallelism int) (*ShardedReader, error) {
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	if b.journal != nil && !b.ingested {
+		if err := b.writers.syncAll(); err != nil {
+			b.rollback(nil)
+			return nil, err
+		}
+	}
+	if err := b.writers.closeAll(); err != nil {
+		b.rollback(nil)
+		return nil, err
+	}
+	if b.runs != nil {
+		if err := b.partitionRuns(); err != nil {
+			b.rollback(nil)
+			return nil, err
+		}
+	}
+	if b.journal != nil && !b.ingested {
+		err := b.journal.append(&journalRecord{
+			Kind:        journalCommit,
+			InputOffset: b.inputOffset,
+			Counts:      b.counts,
+		})
+		if err != nil {
+			b.rollback(nil)
+			return nil, err
+		}
+		b.ingested = true
+	}
+
+	// Tables built from keys files hold them open, so a table with more
+	// shards than b may keep open is dumped and closed shard by shard, and
+	// loaded again on first use.
+	maxOpen := b.writers.maxOpen
+	lazy := b.maxShardKeys > 0 || len(b.counts) > maxOpen
+	shards := make([]*shardNode, len(b.counts))
+	grp, grpCtx := errgroup.WithContext(ctx)
+	grp.SetLimit(parallelism)
+	for i, tblFile := range b.writers.files {
+		if grpCtx.Err() != nil {
+			break
+		}
+		if b.built != nil && b.built[i] != nil {
+			shards[i] = b.built[i]
+			if lazy {
+				continue
+			}
+			grp.Go(func() error {
+				if err := loadBuiltShard(shards[i]); err != nil {
+					return fmt.Errorf("shard %d: %v", i, err)
+				}
+				return nil
+			})
+			continue
+		}
+		if tblFile == nil {
+			continue
+		}
+		grp.Go(func() error {
+			if err := grpCtx.Err(); err != nil {
+				return err
+			}
+			tabFilePath, count := tblFile.Name(), b.counts[i]
+			if b.runs != nil {
+				count -= b.duplicates[i]
+			} else if b.dedup != DedupOff {
+				var err error
+				if tabFilePath, count, err = b.dedupShard(i, tabFilePath, count); err != nil {
+					return err
+				}
+			}
+			var err error
+			shards[i], err = b.buildShard(tabFilePath, count, b.prefBits)
+			if err == nil {
+				err = b.finishShard(i, shards[i])
+			}
+			if err == nil && lazy {
+				err = releaseShardNode(shards[i])
+			}
+			if err != nil {
+				return fmt.Errorf("shard %d: %v", i, err)
+			}
+			if tabFilePath != tblFile.Name() {
+				return os.Remove(tblFile.Name())
+			}
+			return nil
+		})
+	}
+	err := grp.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		b.rollback(shards)
+		return nil, err
+	}
+
+	r := &ShardedReader{
+		shardRouter: b.shardRouter,
+		mphDirPath:  b.mphDirPath,
+	}
+	r.setShards(shards)
+	if lazy {
+		r.cache = newShardCache(len(r.counts), maxOpen, r.loadShard)
+	}
+	b.writers = nil
+	b.committed = true
+	if b.journal != nil {
+		b.journal.close()
+		b.journal = nil
+		os.Remove(filepath.Join(b.mphDirPath, JournalFileName))
+	}
+	b.lock.unlock()
+	b.lock = nil
+	return r, nil
+}
+
+// rollback closes the shards built by a failed commit and closes b. Unless b
+// has a journal, it also removes all shard files written by b.
+func (b *ShardedBuilder) rollback(shards []*shardNode) {
+	b.writers.closeAll()
+	if b.runs != nil {
+		b.runs.removeAll()
+	}
+	if b.journal != nil {
+		for _, node := range shards {
+			closeShardNode(node)
+		}
+		b.journal.close()
+		b.journal = nil
+	} else {
+		for _, node := range shards {
+			removeShardNode(node)
+		}
+		for _, tblFile := range b.writers.files {
+			if tblFile != nil && tblFile.created {
+				os.Remove(tblFile.Name())
+			}
+		}
+	}
+	b.writers = nil
+	b.closed = true
+	b.lock.unlock()
+	b.lock = nil
+}
+
+// GetCounts returns the number of keys put in every shard so far.
+func (b *ShardedBuilder) GetCounts() []uint {
+	return b.counts
+}
+
+// Close releases the shard writers and the directory lock of b, leaving the
+// shard files written so far in place. The sorted runs of a builder created
+// with WithSortedRuns are removed. It returns ErrClosed if b is already
+// closed.
+func (b *ShardedBuilder) Close() error {
+	if b.closed {
+		return ErrClosed
+	}
+	b.closed = true
+	if b.runs != nil {
+		b.runs.removeAll()
+	}
+	if b.journal != nil {
+		b.journal.close()
+		b.journal = nil
+	}
+	b.lock.unlock()
+	b.lock = nil
+	if b.writers == nil {
+		return nil
+	}
+	err := b.writers.closeAll()
+	b.writers = nil
+	return err
+}
+
+// SizeInBytes returns the approximate amount of memory held by b, including
+// its shard write buffers or run buffers.
+func (b *ShardedBuilder) SizeInBytes() int64 {
+	size := int64(unsafe.Sizeof(*b))
+	size += int64(unsafe.Sizeof(uint(0))) * int64(cap(b.counts))
+	if b.runs != nil {
+		size += b.runs.sizeInBytes()
+	}
+	if b.writers != nil {
+		size += b.writers.sizeInBytes()
+	}
+	return size
+}
+
+// OpenFiles returns the number of file descriptors held open by b.
+func (b *ShardedBuilder) OpenFiles() int {
+	if b.writers == nil {
+		return 0
+	}
+	return b.writers.openFiles()
+}
+
+// Stats returns statistics about the distribution of the keys put so far.
+func (b *ShardedBuilder) Stats() ShardedStats {
+	return countStats(b.counts)
+}
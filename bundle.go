@@ -0,0 +1,317 @@
+package mph
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// bundleMagic starts and ends a bundle, which is laid out as
+//
+//	magic | shard 0 | shard 1 | ... | header | header offset | magic
+//
+// where every shard region is a complete keys file, the header is a
+// gob-encoded bundleHeader and the header offset is a little-endian uint64.
+var bundleMagic = [8]byte{'M', 'P', 'H', 'B', 'N', 'D', 'L', '1'}
+
+// bundleTrailerLen is the size of the header offset and the trailing magic.
+const bundleTrailerLen = 16
+
+// A bundleRegion locates one shard within a bundle. Empty shards have a zero
+// region.
+type bundleRegion struct {
+	Off int64
+	Len int64
+}
+
+type bundleHeader struct {
+	Manifest shardManifest
+	Regions  []bundleRegion
+}
+
+// A shardSource is the byte range holding one dumped shard, either within r
+// or, if path is set, the whole file at path.
+type shardSource struct {
+	path string
+	r    io.ReaderAt
+	off  int64
+	size int64
+}
+
+func (src shardSource) copyTo(w io.Writer) (int64, error) {
+	if src.path == "" {
+		return io.Copy(w, io.NewSectionReader(src.r, src.off, src.size))
+	}
+	f, err := os.Open(src.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// DumpToBundle writes a committed table, manifest and shards, to the single
+// file bundlePath. The table can be restored with LoadShardedTableFromFile.
+func (r *ShardedReader) DumpToBundle(bundlePath string) error {
+	if r.closed {
+		return ErrClosed
+	}
+	if r.bundleFile == nil {
+		if err := r.dumpShards(); err != nil {
+			return err
+		}
+	}
+	if err := r.fillChecksums(); err != nil {
+		return err
+	}
+	srcs := make([]shardSource, len(r.counts))
+	for i, cnt := range r.counts {
+		switch {
+		case cnt == 0:
+		case r.bundleFile != nil:
+			region := r.bundleRegions[i]
+			srcs[i] = shardSource{r: r.bundleFile, off: region.Off, size: region.Len}
+		default:
+			srcs[i] = shardSource{path: r.tabFilePaths[i]}
+		}
+	}
+	return writeBundle(bundlePath, r.baseManifest(), srcs)
+}
+
+// PackBundle packs the table described by the manifest at manifestPath, whose
+// shards must have been dumped with DumpToFile, into the single file
+// bundlePath.
+func PackBundle(manifestPath, bundlePath string, opts ...LoadOption) error {
+	m, _, tabFilePaths, err := openIndex(manifestPath, opts)
+	if err != nil {
+		return err
+	}
+	srcs := make([]shardSource, len(m.Counts))
+	for i, tabFilePath := range tabFilePaths {
+		if m.Counts[i] == 0 {
+			continue
+		}
+		if err = checkKeysFooter(tabFilePath); err != nil {
+			return fmt.Errorf("shard %d (%s): %v", i, tabFilePath, err)
+		}
+		srcs[i] = shardSource{path: tabFilePath}
+	}
+	return writeBundle(bundlePath, m, srcs)
+}
+
+// UnpackBundle extracts the shards of the bundle at bundlePath into
+// mphDirPath and writes a manifest for them to manifestPath, as if the table
+// had been dumped with DumpToFile. mphDirPath is created if needed and locked
+// while the shards are written. If it already holds index files, they are
+// removed if overwrite is set and ErrIndexExists is returned otherwise.
+func UnpackBundle(bundlePath, manifestPath, mphDirPath string, overwrite bool) error {
+	bundleFile, err := os.Open(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer bundleFile.Close()
+	lock, err := prepareDir(mphDirPath, overwrite)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	hdr, err := readBundleHeader(bundleFile)
+	if err != nil {
+		return err
+	}
+
+	m := hdr.Manifest
+	m.Version = manifestVersion
+	if m.MphDirPath, err = relPath(filepath.Dir(manifestPath), mphDirPath); err != nil {
+		return err
+	}
+	m.TabFilePaths = make([]string, len(m.Counts))
+	for i, region := range hdr.Regions {
+		if region.Len == 0 {
+			continue
+		}
+		m.TabFilePaths[i] = strconv.Itoa(i) + ".bin"
+		src := io.NewSectionReader(bundleFile, region.Off, region.Len)
+		err = writeFileAtomic(filepath.Join(mphDirPath, m.TabFilePaths[i]), func(w io.Writer) error {
+			_, err := io.Copy(w, src)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return writeManifest(manifestPath, &m)
+}
+
+func checkKeysFooter(keysFilePath string) error {
+	keysFile, err := os.Open(keysFilePath)
+	if err != nil {
+		return err
+	}
+	defer keysFile.Close()
+	stats, err := keysFile.Stat()
+	if err != nil {
+		return err
+	}
+	_, _, ok, err := readKeysTrailer(keysFile, stats.Size())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("keys file has no footer")
+	}
+	return nil
+}
+
+func writeBundle(bundlePath string, m *shardManifest, srcs []shardSource) error {
+	hdr := bundleHeader{Manifest: *m, Regions: make([]bundleRegion, len(srcs))}
+	hdr.Manifest.MphDirPath = ""
+	hdr.Manifest.TabFilePaths = nil
+	return writeFileAtomic(bundlePath, func(w io.Writer) error {
+		if _, err := w.Write(bundleMagic[:]); err != nil {
+			return err
+		}
+		off := int64(len(bundleMagic))
+		for i, src := range srcs {
+			if src.r == nil && src.path == "" {
+				continue
+			}
+			n, err := src.copyTo(w)
+			if err != nil {
+				return err
+			}
+			hdr.Regions[i] = bundleRegion{Off: off, Len: n}
+			off += n
+		}
+		if err := gob.NewEncoder(w).Encode(&hdr); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint64(off)); err != nil {
+			return err
+		}
+		_, err := w.Write(bundleMagic[:])
+		return err
+	})
+}
+
+// writeFileAtomic writes filePath through a buffered writer passed to write,
+// replacing any existing file only once all of it has been written and
+// committed to stable storage. The replacement itself is made durable by
+// syncing the parent directory.
+func writeFileAtomic(filePath string, write func(w io.Writer) error) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	buff := bufio.NewWriterSize(tmpFile, 1<<20)
+	if err = write(buff); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = buff.Flush(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Chmod(0644); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpFile.Name(), filePath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filePath))
+}
+
+func isBundle(filePath string) (bool, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	buff := make([]byte, len(bundleMagic))
+	if _, err = io.ReadFull(f, buff); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(buff, bundleMagic[:]), nil
+}
+
+func readBundleHeader(bundleFile *os.File) (*bundleHeader, error) {
+	stats, err := bundleFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stats.Size()
+	if size < int64(len(bundleMagic))+bundleTrailerLen {
+		return nil, fmt.Errorf("bundle too short")
+	}
+	trailer := make([]byte, bundleTrailerLen)
+	if _, err = bundleFile.ReadAt(trailer, size-bundleTrailerLen); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(trailer[8:], bundleMagic[:]) {
+		return nil, fmt.Errorf("bundle trailer magic mismatch")
+	}
+	hdrOff := int64(binary.LittleEndian.Uint64(trailer[:8]))
+	if hdrOff < int64(len(bundleMagic)) || hdrOff > size-bundleTrailerLen {
+		return nil, fmt.Errorf("bundle header offset %d out of range", hdrOff)
+	}
+	var hdr bundleHeader
+	hdrReader := io.NewSectionReader(bundleFile, hdrOff, size-bundleTrailerLen-hdrOff)
+	if err = gob.NewDecoder(hdrReader).Decode(&hdr); err != nil {
+		return nil, err
+	}
+	if len(hdr.Regions) != len(hdr.Manifest.Counts) {
+		return nil, fmt.Errorf(
+			"bundle has %d regions for %d shards",
+			len(hdr.Regions),
+			len(hdr.Manifest.Counts),
+		)
+	}
+	for i, region := range hdr.Regions {
+		if region.Off < 0 || region.Len < 0 || region.Off+region.Len > hdrOff {
+			return nil, fmt.Errorf("shard %d region out of range", i)
+		}
+	}
+	return &hdr, nil
+}
+
+func loadBundle(bundlePath string, lo *loadOptions) (*ShardedReader, error) {
+	bundleFile, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := readBundleHeader(bundleFile)
+	if err != nil {
+		bundleFile.Close()
+		return nil, err
+	}
+	r, err := newShardedReaderFromManifest(&hdr.Manifest)
+	if err != nil {
+		bundleFile.Close()
+		return nil, err
+	}
+	r.bundleFile = bundleFile
+	r.bundleRegions = hdr.Regions
+	if err = r.loadShards(lo); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,73 @@
+package mph
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDumpToBundle(t *testing.T) {
+	keys := sha1Keys(2000)
+	dir := t.TempDir()
+	st := buildShardedTable(t, filepath.Join(dir, "shards"), keys, 3)
+
+	bundlePath := filepath.Join(dir, "sharded.bundle")
+	if err := st.DumpToBundle(bundlePath); err != nil {
+		t.Fatal(err)
+	}
+	// The bundle is self-contained.
+	if err := os.RemoveAll(filepath.Join(dir, "shards")); err != nil {
+		t.Fatal(err)
+	}
+	st, err := LoadShardedTableFromFile(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkShardedLookups(t, st, keys)
+	if _, ok := st.Lookup(make([]byte, len(keys[0]))); ok {
+		t.Error("Lookup(zero key): got ok; want !ok")
+	}
+
+	// Re-bundling a bundle-backed table copies its regions.
+	rebundlePath := filepath.Join(dir, "rebundled.bundle")
+	if err = st.DumpToBundle(rebundlePath); err != nil {
+		t.Fatal(err)
+	}
+	st, err = LoadShardedTableFromFile(rebundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkShardedLookups(t, st, keys)
+}
+
+func TestPackUnpackBundle(t *testing.T) {
+	keys := sha1Keys(2000)
+	dir := t.TempDir()
+	st := buildShardedTable(t, filepath.Join(dir, "shards"), keys, 4)
+	manifestPath := filepath.Join(dir, "sharded.mph")
+	if err := st.DumpToFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+
+	bundlePath := filepath.Join(dir, "sharded.bundle")
+	if err := PackBundle(manifestPath, bundlePath); err != nil {
+		t.Fatal(err)
+	}
+
+	outDir := filepath.Join(t.TempDir(), "unpacked")
+	unpackedPath := filepath.Join(outDir, "sharded.mph")
+	if err := UnpackBundle(bundlePath, unpackedPath, outDir, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackBundle(bundlePath, unpackedPath, outDir, false); err != ErrIndexExists {
+		t.Errorf("UnpackBundle into a shard directory in use: got %v; want ErrIndexExists", err)
+	}
+	if err := UnpackBundle(bundlePath, unpackedPath, outDir, true); err != nil {
+		t.Fatal(err)
+	}
+	st, err := LoadShardedTableFromFile(unpackedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkShardedLookups(t, st, keys)
+}
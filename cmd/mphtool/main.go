@@ -0,0 +1,171 @@
+// Command mphtool manages sharded minimal perfect hash indexes built with
+// package mph.
+//
+// Usage:
+//
+//	mphtool pack [-base dir] manifest bundle
+//	mphtool unpack [-overwrite] bundle manifest shardDir
+//	mphtool gc [-base dir] manifest
+//	mphtool destroy [-base dir] manifest
+//	mphtool rollback root
+//	mphtool prune [-keep n] [-max-age d] root
+//	mphtool verify [-base dir] [-lookups] manifest|bundle
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Kalyan-Rubrik/mph"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "pack":
+		err = pack(os.Args[2:])
+	case "unpack":
+		err = unpack(os.Args[2:])
+	case "gc":
+		err = gc(os.Args[2:])
+	case "destroy":
+		err = destroy(os.Args[2:])
+	case "rollback":
+		err = rollback(os.Args[2:])
+	case "prune":
+		err = prune(os.Args[2:])
+	case "verify":
+		err = verify(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mphtool %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage:")
+	fmt.Fprintln(os.Stderr, "\tmphtool pack [-base dir] manifest bundle")
+	fmt.Fprintln(os.Stderr, "\tmphtool unpack [-overwrite] bundle manifest shardDir")
+	fmt.Fprintln(os.Stderr, "\tmphtool gc [-base dir] manifest")
+	fmt.Fprintln(os.Stderr, "\tmphtool destroy [-base dir] manifest")
+	fmt.Fprintln(os.Stderr, "\tmphtool rollback root")
+	fmt.Fprintln(os.Stderr, "\tmphtool prune [-keep n] [-max-age d] root")
+	fmt.Fprintln(os.Stderr, "\tmphtool verify [-base dir] [-lookups] manifest|bundle")
+	os.Exit(2)
+}
+
+func pack(args []string) error {
+	fs := flag.NewFlagSet("pack", flag.ExitOnError)
+	baseDir := fs.String("base", "", "resolve manifest paths against `dir`")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+	var opts []mph.LoadOption
+	if *baseDir != "" {
+		opts = append(opts, mph.WithBaseDir(*baseDir))
+	}
+	return mph.PackBundle(fs.Arg(0), fs.Arg(1), opts...)
+}
+
+func unpack(args []string) error {
+	fs := flag.NewFlagSet("unpack", flag.ExitOnError)
+	overwrite := fs.Bool("overwrite", false, "replace the index files already in shardDir")
+	fs.Parse(args)
+	if fs.NArg() != 3 {
+		usage()
+	}
+	return mph.UnpackBundle(fs.Arg(0), fs.Arg(1), fs.Arg(2), *overwrite)
+}
+
+// manifestArgs parses the arguments of a subcommand that takes a manifest and
+// the -base flag.
+func manifestArgs(name string, args []string) (string, []mph.LoadOption) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	baseDir := fs.String("base", "", "resolve manifest paths against `dir`")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	var opts []mph.LoadOption
+	if *baseDir != "" {
+		opts = append(opts, mph.WithBaseDir(*baseDir))
+	}
+	return fs.Arg(0), opts
+}
+
+func gc(args []string) error {
+	manifestPath, opts := manifestArgs("gc", args)
+	removed, err := mph.CollectGarbage(manifestPath, opts...)
+	for _, p := range removed {
+		fmt.Println("removed", p)
+	}
+	return err
+}
+
+func destroy(args []string) error {
+	manifestPath, opts := manifestArgs("destroy", args)
+	return mph.DestroyShardedTable(manifestPath, opts...)
+}
+
+func rollback(args []string) error {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	genDir, err := mph.RollbackGeneration(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Println("current", genDir)
+	return nil
+}
+
+func prune(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	keep := fs.Int("keep", 0, "keep the `n` newest generations")
+	maxAge := fs.Duration("max-age", 0, "remove generations older than `d`")
+	fs.Parse(args)
+	if fs.NArg() != 1 || (*keep <= 0 && *maxAge <= 0) {
+		usage()
+	}
+	removed, err := mph.PruneGenerations(fs.Arg(0), *keep, *maxAge)
+	for _, p := range removed {
+		fmt.Println("removed", p)
+	}
+	return err
+}
+
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	baseDir := fs.String("base", "", "resolve manifest paths against `dir`")
+	lookups := fs.Bool("lookups", false, "look up every key")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	var opts []mph.LoadOption
+	if *baseDir != "" {
+		opts = append(opts, mph.WithBaseDir(*baseDir))
+	}
+	rep, err := mph.Verify(fs.Arg(0), *lookups, opts...)
+	if err != nil {
+		return err
+	}
+	for _, p := range rep.Problems {
+		fmt.Println(p.Error())
+	}
+	if !rep.OK() {
+		return fmt.Errorf("%d of %d shards have problems", len(rep.Problems), rep.Shards)
+	}
+	fmt.Printf("%d shards, %d keys: ok\n", rep.Shards, rep.Keys)
+	return nil
+}
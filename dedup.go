@@ -0,0 +1,326 @@
+package mph
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A DedupMode selects how a ShardedBuilder handles duplicate keys, which
+// otherwise make Commit fail after a long search for seeds.
+type DedupMode int
+
+const (
+	// DedupOff puts every key as is. This is the default.
+	DedupOff DedupMode = iota
+
+	// DedupDrop keeps one copy of every key and counts the copies dropped
+	// from every shard; see ShardedBuilder.Duplicates.
+	DedupDrop
+
+	// DedupStrict makes Commit fail with a *DuplicateKeysError if a shard
+	// holds duplicate keys.
+	DedupStrict
+)
+
+// DefaultDedupMemory is the size of the keys a shard may hold for its
+// duplicates to be eliminated in memory, unless configured with
+// WithDedupMemory. Larger shards are deduplicated with an external sort that
+// uses as much memory.
+const DefaultDedupMemory = 64 << 20
+
+// maxReportedDuplicates caps DuplicateKeysError.Keys.
+const maxReportedDuplicates = 100
+
+// A DuplicateKeysError is returned by the Commit of a ShardedBuilder in
+// DedupStrict mode when a shard holds duplicate keys.
+type DuplicateKeysError struct {
+	Shard int
+	Count uint     // copies in excess of one
+	Keys  [][]byte // duplicated keys, at most 100 of them
+}
+
+func (e *DuplicateKeysError) Error() string {
+	keys := make([]string, len(e.Keys))
+	for i, key := range e.Keys {
+		keys[i] = hex.EncodeToString(key)
+	}
+	return fmt.Sprintf(
+		"mph: shard %d has %d duplicate keys: %s",
+		e.Shard,
+		e.Count,
+		strings.Join(keys, ", "),
+	)
+}
+
+// Duplicates returns the number of duplicate keys dropped from every shard
+// by Commit in DedupDrop mode.
+func (b *ShardedBuilder) Duplicates() []uint {
+	return b.duplicates
+}
+
+// A dedupResult collects the duplicates found in a shard.
+type dedupResult struct {
+	count uint
+	keys  [][]byte
+}
+
+func (res *dedupResult) add(key []byte) {
+	res.count++
+	if len(res.keys) >= maxReportedDuplicates {
+		return
+	}
+	isKey := func(k []byte) bool { return bytes.Equal(k, key) }
+	if !slices.ContainsFunc(res.keys, isKey) {
+		res.keys = append(res.keys, slices.Clone(key))
+	}
+}
+
+// dedupShard eliminates the duplicates among the count keys in tabFilePath.
+// If there are any, the unique keys are written to a new keys file, whose
+// path and key count are returned; tabFilePath itself is left untouched so
+// that a journaled build can start over from it.
+func (b *ShardedBuilder) dedupShard(shardIdx int, tabFilePath string, count uint) (string, uint, error) {
+	dedupPath := derivedPath(tabFilePath, "dedup")
+	var res dedupResult
+	var err error
+	if int64(count)*int64(b.keyLen) <= int64(b.dedupMemory) {
+		err = b.dedupInMemory(tabFilePath, dedupPath, count, &res)
+	} else {
+		err = b.dedupExternal(tabFilePath, dedupPath, count, &res)
+	}
+	if err != nil {
+		os.Remove(dedupPath)
+		return "", 0, err
+	}
+	if res.count == 0 {
+		os.Remove(dedupPath)
+		return tabFilePath, count, nil
+	}
+	if b.dedup == DedupStrict {
+		os.Remove(dedupPath)
+		return "", 0, &DuplicateKeysError{Shard: shardIdx, Count: res.count, Keys: res.keys}
+	}
+	b.duplicates[shardIdx] = res.count
+	return dedupPath, count - res.count, nil
+}
+
+// derivedPath returns the path of a file derived from keys file tabFilePath,
+// marked with tag.
+func derivedPath(tabFilePath, tag string) string {
+	return strings.TrimSuffix(tabFilePath, ".bin") + "." + tag + ".bin"
+}
+
+func (b *ShardedBuilder) dedupInMemory(tabFilePath, dedupPath string, count uint, res *dedupResult) error {
+	keys, err := os.ReadFile(tabFilePath)
+	if err != nil {
+		return err
+	}
+	keysLen := int(count) * b.keyLen
+	if len(keys) < keysLen {
+		return fmt.Errorf("keys file holds %d bytes, expected %d", len(keys), keysLen)
+	}
+	seen := make(map[string]struct{}, count)
+	unique := keys[:0]
+	for off := 0; off < keysLen; off += b.keyLen {
+		key := keys[off : off+b.keyLen]
+		if _, dup := seen[string(key)]; dup {
+			res.add(key)
+			continue
+		}
+		seen[string(key)] = struct{}{}
+		unique = append(unique, key...)
+	}
+	if res.count == 0 || b.dedup == DedupStrict {
+		return nil
+	}
+	return os.WriteFile(dedupPath, unique, 0644)
+}
+
+// dedupExternal sorts the keys in tabFilePath into runs that fit in the
+// dedup memory of b, then merges the runs into dedupPath, dropping repeated
+// keys. Runs are merged at most WithMaxOpenFiles-1 at a time.
+func (b *ShardedBuilder) dedupExternal(tabFilePath, dedupPath string, count uint, res *dedupResult) error {
+	runKeys := max(b.dedupMemory/b.keyLen, 1)
+	var runPaths []string
+	defer func() {
+		for _, runPath := range runPaths {
+			os.Remove(runPath)
+		}
+	}()
+	next := 0
+	nextRunPath := func() string {
+		runPath := derivedPath(tabFilePath, "run"+strconv.Itoa(next))
+		next++
+		return runPath
+	}
+	err := func() error {
+		src, err := os.Open(tabFilePath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		buff := make([]byte, runKeys*b.keyLen)
+		for remaining := int(count); remaining > 0; remaining -= runKeys {
+			n := min(remaining, runKeys) * b.keyLen
+			if _, err = io.ReadFull(src, buff[:n]); err != nil {
+				return err
+			}
+			runPath := nextRunPath()
+			runPaths = append(runPaths, runPath)
+			if err = writeSortedRun(runPath, buff[:n], b.keyLen); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	fanIn := max(b.writers.maxOpen-1, 2)
+	if runPaths, err = reduceRuns(runPaths, b.keyLen, fanIn, nextRunPath); err != nil {
+		return err
+	}
+	return writeRunFile(dedupPath, func(w io.Writer) error {
+		return mergeRuns(runPaths, b.keyLen, func(key, prev []byte) error {
+			if prev != nil && bytes.Equal(key, prev) {
+				res.add(key)
+				return nil
+			}
+			if b.dedup == DedupStrict {
+				return nil
+			}
+			_, err := w.Write(key)
+			return err
+		})
+	})
+}
+
+// writeSortedRun sorts the records of length recLen in recs in place and
+// writes them to runPath.
+func writeSortedRun(runPath string, recs []byte, recLen int) error {
+	idxs := make([]int, len(recs)/recLen)
+	for i := range idxs {
+		idxs[i] = i * recLen
+	}
+	slices.SortFunc(idxs, func(a, b int) int {
+		return bytes.Compare(recs[a:a+recLen], recs[b:b+recLen])
+	})
+	return writeRunFile(runPath, func(w io.Writer) error {
+		for _, off := range idxs {
+			if _, err := w.Write(recs[off : off+recLen]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writeRunFile writes the scratch file runPath through a buffered writer
+// passed to write, removing it on failure. Unlike writeFileAtomic, it does not
+// make the file durable, since the file does not outlive the build.
+func writeRunFile(runPath string, write func(w io.Writer) error) error {
+	f, err := os.Create(runPath)
+	if err != nil {
+		return err
+	}
+	buff := bufio.NewWriterSize(f, 1<<20)
+	err = write(buff)
+	if err == nil {
+		err = buff.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(runPath)
+	}
+	return err
+}
+
+// reduceRuns merges the sorted runs of records of length recLen at runPaths,
+// fanIn at a time into new runs at paths from newRunPath, until at most fanIn
+// of them are left, and returns the paths of the runs left. Merged runs are
+// removed. On failure, the paths of the runs left so far are returned too.
+func reduceRuns(runPaths []string, recLen, fanIn int, newRunPath func() string) ([]string, error) {
+	for len(runPaths) > fanIn {
+		runPath := newRunPath()
+		err := writeRunFile(runPath, func(w io.Writer) error {
+			return mergeRuns(runPaths[:fanIn], recLen, func(rec, _ []byte) error {
+				_, err := w.Write(rec)
+				return err
+			})
+		})
+		if err != nil {
+			return runPaths, err
+		}
+		for _, merged := range runPaths[:fanIn] {
+			os.Remove(merged)
+		}
+		runPaths = append(runPaths[fanIn:], runPath)
+	}
+	return runPaths, nil
+}
+
+// A runReader is the head of a sorted run being merged.
+type runReader struct {
+	r   *bufio.Reader
+	key []byte
+}
+
+type runHeap []*runReader
+
+func (h runHeap) Len() int           { return len(h) }
+func (h runHeap) Less(i, j int) bool { return bytes.Compare(h[i].key, h[j].key) < 0 }
+func (h runHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)        { *h = append(*h, x.(*runReader)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// mergeRuns merges the sorted runs of records of length recLen at runPaths,
+// passing every record in order, along with the previous one, to emit.
+func mergeRuns(runPaths []string, recLen int, emit func(rec, prev []byte) error) error {
+	h := make(runHeap, 0, len(runPaths))
+	for _, runPath := range runPaths {
+		f, err := os.Open(runPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rr := &runReader{r: bufio.NewReader(f), key: make([]byte, recLen)}
+		if _, err = io.ReadFull(rr.r, rr.key); err == io.EOF {
+			continue
+		} else if err != nil {
+			return err
+		}
+		h = append(h, rr)
+	}
+	heap.Init(&h)
+	var prev []byte
+	for h.Len() > 0 {
+		rr := h[0]
+		if err := emit(rr.key, prev); err != nil {
+			return err
+		}
+		prev = append(prev[:0], rr.key...)
+		if _, err := io.ReadFull(rr.r, rr.key); err == io.EOF {
+			heap.Pop(&h)
+		} else if err != nil {
+			return err
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	return nil
+}
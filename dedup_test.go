@@ -0,0 +1,106 @@
+package mph
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestShardedBuilderDedup(t *testing.T) {
+	keys := sha1Keys(2000)
+	for _, dedupMemory := range []int{DefaultDedupMemory, 10 * sha1.Size} {
+		// Runs of 10 keys are merged 2 at a time.
+		mphDir := t.TempDir()
+		b, err := NewShardedBuilder(
+			sha1.Size,
+			2,
+			1024,
+			mphDir,
+			WithDedup(DedupDrop),
+			WithDedupMemory(dedupMemory),
+			WithMaxOpenFiles(3),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			if err = b.Put(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, key := range keys[:300] {
+			if err = b.Put(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, key := range keys[:50] {
+			if err = b.Put(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		st, err := b.Commit(context.Background(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dropped uint
+		for _, n := range b.Duplicates() {
+			dropped += n
+		}
+		if dropped != 350 {
+			t.Errorf("dedup memory %d: dropped %d duplicates; want 350", dedupMemory, dropped)
+		}
+		if got := st.NumKeys(); got != uint64(len(keys)) {
+			t.Errorf("dedup memory %d: NumKeys: got %d; want %d", dedupMemory, got, len(keys))
+		}
+		checkShardedLookups(t, st, keys)
+		st.Close()
+		runs, err := filepath.Glob(filepath.Join(mphDir, "*.run*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(runs) != 0 {
+			t.Errorf("dedup memory %d: run files left after Commit: %v", dedupMemory, runs)
+		}
+	}
+}
+
+func TestShardedBuilderDedupStrict(t *testing.T) {
+	keys := sha1Keys(1000)
+	for _, dedupMemory := range []int{DefaultDedupMemory, 10 * sha1.Size} {
+		mphDir := t.TempDir()
+		b, err := NewShardedBuilder(
+			sha1.Size,
+			2,
+			1024,
+			mphDir,
+			WithDedup(DedupStrict),
+			WithDedupMemory(dedupMemory),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range append(keys, keys[7], keys[7], keys[9]) {
+			if err = b.Put(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = b.Commit(context.Background(), 1)
+		var dupErr *DuplicateKeysError
+		if !errors.As(err, &dupErr) {
+			t.Fatalf("dedup memory %d: Commit: got %v; want a DuplicateKeysError", dedupMemory, err)
+		}
+		var found bool
+		for _, key := range dupErr.Keys {
+			found = found || string(key) == string(keys[7]) || string(key) == string(keys[9])
+		}
+		if !found || dupErr.Count == 0 {
+			t.Errorf("dedup memory %d: got %+v; want keys 7 or 9", dedupMemory, dupErr)
+		}
+		entries := shardDirEntries(t, mphDir)
+		if len(entries) != 0 {
+			t.Errorf("dedup memory %d: shard dir after failed Commit: got %d entries; want none", dedupMemory, len(entries))
+		}
+	}
+}
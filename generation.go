@@ -0,0 +1,255 @@
+package mph
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CurrentFileName is the name of the file in a generation root directory that
+// names the published generation.
+const CurrentFileName = "CURRENT"
+
+// GenerationManifestName is the name of the manifest in a published
+// generation directory.
+const GenerationManifestName = "manifest.mph"
+
+const generationPrefix = "gen-"
+
+// ErrNoGeneration is returned when a generation root directory has no
+// published generation, or none to roll back to.
+var ErrNoGeneration = errors.New("mph: no published generation")
+
+// A Generation is a generation directory under a root directory.
+type Generation struct {
+	Name      string
+	Path      string
+	ModTime   time.Time // of the manifest, or of the directory if unpublished
+	Published bool      // the generation has a manifest
+	Current   bool      // CURRENT names the generation
+}
+
+func generationName(n int) string {
+	return fmt.Sprintf("%s%08d", generationPrefix, n)
+}
+
+// generationNumber returns the number of generation name, or -1 if name is
+// not a generation name.
+func generationNumber(name string) int {
+	digits, ok := strings.CutPrefix(name, generationPrefix)
+	if !ok {
+		return -1
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// NewGeneration creates the next generation directory under rootDir, which is
+// created if needed, and returns its path, to be passed to NewShardedBuilder.
+func NewGeneration(rootDir string) (string, error) {
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		return "", err
+	}
+	gens, err := ListGenerations(rootDir)
+	if err != nil {
+		return "", err
+	}
+	n := 1
+	if len(gens) > 0 {
+		n = generationNumber(gens[len(gens)-1].Name) + 1
+	}
+	for {
+		genDir := filepath.Join(rootDir, generationName(n))
+		err = os.Mkdir(genDir, 0755)
+		if err == nil {
+			return genDir, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+		// Taken by a concurrent NewGeneration.
+		n++
+	}
+}
+
+// ListGenerations returns the generations under rootDir, oldest first.
+func ListGenerations(rootDir string) ([]Generation, error) {
+	entries, err := os.ReadDir(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	current, err := readCurrent(rootDir)
+	if err != nil && !errors.Is(err, ErrNoGeneration) {
+		return nil, err
+	}
+	var gens []Generation
+	for _, entry := range entries {
+		if !entry.IsDir() || generationNumber(entry.Name()) < 0 {
+			continue
+		}
+		gen := Generation{
+			Name:    entry.Name(),
+			Path:    filepath.Join(rootDir, entry.Name()),
+			Current: entry.Name() == current,
+		}
+		info, err := os.Stat(filepath.Join(gen.Path, GenerationManifestName))
+		if err == nil {
+			gen.Published = true
+		} else if errors.Is(err, os.ErrNotExist) {
+			info, err = entry.Info()
+		}
+		if err != nil {
+			return nil, err
+		}
+		gen.ModTime = info.ModTime()
+		gens = append(gens, gen)
+	}
+	slices.SortFunc(gens, func(a, b Generation) int {
+		return generationNumber(a.Name) - generationNumber(b.Name)
+	})
+	return gens, nil
+}
+
+// readCurrent returns the name of the generation that CURRENT names.
+func readCurrent(rootDir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(rootDir, CurrentFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrNoGeneration
+	}
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(string(data))
+	if generationNumber(name) < 0 {
+		return "", fmt.Errorf("%s names invalid generation %q", CurrentFileName, name)
+	}
+	return name, nil
+}
+
+func writeCurrent(rootDir, name string) error {
+	return writeFileAtomic(filepath.Join(rootDir, CurrentFileName), func(w io.Writer) error {
+		_, err := io.WriteString(w, name+"\n")
+		return err
+	})
+}
+
+// CurrentManifest returns the path of the manifest of the published
+// generation under rootDir, to be loaded with LoadShardedTableFromFile.
+func CurrentManifest(rootDir string) (string, error) {
+	name, err := readCurrent(rootDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(rootDir, name, GenerationManifestName), nil
+}
+
+// PublishGeneration dumps r, which must have been built in a generation
+// directory from NewGeneration, to the manifest of its generation and makes
+// it the current generation of rootDir.
+func PublishGeneration(r *ShardedReader, rootDir string) error {
+	genDir, err := filepath.Abs(r.mphDirPath)
+	if err != nil {
+		return err
+	}
+	absRoot, err := filepath.Abs(rootDir)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(genDir)
+	if filepath.Dir(genDir) != absRoot || generationNumber(name) < 0 {
+		return fmt.Errorf("%s is not a generation directory of %s", r.mphDirPath, rootDir)
+	}
+	lock, err := lockDir(rootDir)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	if err = r.DumpToFile(filepath.Join(genDir, GenerationManifestName)); err != nil {
+		return err
+	}
+	return writeCurrent(rootDir, name)
+}
+
+// RollbackGeneration makes the newest published generation older than the
+// current one current again, and returns its path. It returns
+// ErrNoGeneration if there is no such generation.
+func RollbackGeneration(rootDir string) (string, error) {
+	lock, err := lockDir(rootDir)
+	if err != nil {
+		return "", err
+	}
+	defer lock.unlock()
+	current, err := readCurrent(rootDir)
+	if err != nil {
+		return "", err
+	}
+	gens, err := ListGenerations(rootDir)
+	if err != nil {
+		return "", err
+	}
+	for i := len(gens) - 1; i >= 0; i-- {
+		gen := gens[i]
+		if gen.Published && generationNumber(gen.Name) < generationNumber(current) {
+			if err = writeCurrent(rootDir, gen.Name); err != nil {
+				return "", err
+			}
+			return gen.Path, nil
+		}
+	}
+	return "", ErrNoGeneration
+}
+
+// PruneGenerations removes the generations under rootDir, other than the
+// current one, that are not among the keep newest generations or that are
+// older than maxAge, and returns their paths. A keep or maxAge of zero or less
+// disables the corresponding limit. Generations locked by a builder are left
+// alone. Readers must not lazily load shards of a generation after it is
+// removed.
+func PruneGenerations(rootDir string, keep int, maxAge time.Duration) ([]string, error) {
+	lock, err := lockDir(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+	gens, err := ListGenerations(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	var errs []error
+	for i, gen := range gens {
+		if gen.Current {
+			continue
+		}
+		tooMany := keep > 0 && i < len(gens)-keep
+		tooOld := maxAge > 0 && time.Since(gen.ModTime) > maxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		genLock, err := lockDir(gen.Path)
+		if errors.Is(err, ErrLocked) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err = os.RemoveAll(gen.Path)
+		genLock.unlock()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, gen.Path)
+	}
+	return removed, errors.Join(errs...)
+}
@@ -0,0 +1,99 @@
+package mph
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestGenerations(t *testing.T) {
+	rootDir := t.TempDir()
+	if _, err := CurrentManifest(rootDir); err != ErrNoGeneration {
+		t.Fatalf("CurrentManifest before publishing: got %v; want ErrNoGeneration", err)
+	}
+	keys := sha1Keys(900)
+	var genDirs []string
+	for g := 1; g <= 3; g++ {
+		genDir, err := NewGeneration(rootDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		genDirs = append(genDirs, genDir)
+		st := buildShardedTable(t, genDir, keys[:300*g], 2)
+		err = PublishGeneration(st, rootDir)
+		st.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkCurrentGeneration(t, rootDir, keys[:300*g])
+	}
+
+	// An unpublished generation is neither current nor rolled back to.
+	if _, err := NewGeneration(rootDir); err != nil {
+		t.Fatal(err)
+	}
+	genDir, err := RollbackGeneration(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if genDir != genDirs[1] {
+		t.Errorf("RollbackGeneration: got %s; want %s", genDir, genDirs[1])
+	}
+	checkCurrentGeneration(t, rootDir, keys[:600])
+
+	removed, err := PruneGenerations(rootDir, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(removed, genDirs[:1]) {
+		t.Errorf("PruneGenerations by count: got %v; want %v", removed, genDirs[:1])
+	}
+	if _, err = RollbackGeneration(rootDir); err != ErrNoGeneration {
+		t.Errorf("RollbackGeneration past the oldest generation: got %v; want ErrNoGeneration", err)
+	}
+
+	removed, err = PruneGenerations(rootDir, 0, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("PruneGenerations by age: got %v; want 2 generations", removed)
+	}
+	gens, err := ListGenerations(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gens) != 1 || !gens[0].Current || gens[0].Path != genDirs[1] {
+		t.Errorf("generations after pruning: got %+v; want only %s", gens, genDirs[1])
+	}
+	checkCurrentGeneration(t, rootDir, keys[:600])
+}
+
+func TestPublishGenerationOutsideRoot(t *testing.T) {
+	st := buildShardedTable(t, t.TempDir(), sha1Keys(100), 2)
+	defer st.Close()
+	if err := PublishGeneration(st, t.TempDir()); err == nil {
+		t.Error("PublishGeneration of a table outside the root: got nil error; want error")
+	}
+}
+
+func checkCurrentGeneration(t *testing.T, rootDir string, keys [][]byte) {
+	t.Helper()
+	manifestPath, err := CurrentManifest(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(manifestPath) != GenerationManifestName {
+		t.Errorf("CurrentManifest: got %s", manifestPath)
+	}
+	st, err := LoadShardedTableFromFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if got := st.NumKeys(); got != uint64(len(keys)) {
+		t.Errorf("NumKeys of current generation: got %d; want %d", got, len(keys))
+	}
+	checkShardedLookups(t, st, keys)
+}
@@ -0,0 +1,420 @@
+package mph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// JournalFileName is the name of the progress journal in the shard directory
+// of a ShardedBuilder created with WithJournal.
+const JournalFileName = "mph.journal"
+
+// journalFrameLen is the length of the frame of every journal record: the
+// little-endian u32 length and CRC-32 of its gob-encoded body. A torn record
+// at the end of the journal is ignored and overwritten on resume.
+const journalFrameLen = 8
+
+type journalKind int
+
+const (
+	// journalStart records the configuration of the builder.
+	journalStart journalKind = iota + 1
+	// journalCheckpoint records the input offset and shard counts that are
+	// safely in the shard files.
+	journalCheckpoint
+	// journalCommit records that ingestion is complete and Commit started,
+	// with the final shard counts.
+	journalCommit
+	// journalBuilt records that a top-level shard is built and dumped.
+	journalBuilt
+)
+
+type journalRecord struct {
+	Kind journalKind
+
+	// journalStart
+	KeyLen       int
+	PrefBits     int
+	ShardFunc    string
+	MaxShardKeys uint
+	BuffSzBytes  int
+	Dedup        DedupMode
+	DedupMemory  int
+
+	// journalCheckpoint and journalCommit
+	InputOffset uint64
+	Counts      []uint
+
+	// journalBuilt
+	Shard int
+	Tree  *journalNode
+}
+
+// A journalNode is a built shardNode. Path is relative to the shard
+// directory.
+type journalNode struct {
+	Path     string
+	Count    uint
+	Children []*journalNode
+}
+
+// A journal appends records to the journal file of a ShardedBuilder.
+type journal struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func createJournal(dirPath string) (*journal, error) {
+	f, err := os.OpenFile(
+		filepath.Join(dirPath, JournalFileName),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{file: f}, nil
+}
+
+// append writes rec to the journal and syncs it to stable storage.
+func (j *journal) append(rec *journalRecord) error {
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(rec); err != nil {
+		return err
+	}
+	frame := make([]byte, journalFrameLen, journalFrameLen+body.Len())
+	binary.LittleEndian.PutUint32(frame[:4], uint32(body.Len()))
+	binary.LittleEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(body.Bytes()))
+	frame = append(frame, body.Bytes()...)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(frame); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+// readJournal returns the records of the journal at journalPath and the
+// length of the prefix of the file that holds them.
+func readJournal(journalPath string) ([]journalRecord, int64, error) {
+	data, err := os.ReadFile(journalPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	var recs []journalRecord
+	var off int64
+	for int64(len(data))-off >= journalFrameLen {
+		frame := data[off : off+journalFrameLen]
+		bodyLen := int64(binary.LittleEndian.Uint32(frame[:4]))
+		if int64(len(data))-off-journalFrameLen < bodyLen {
+			break
+		}
+		body := data[off+journalFrameLen : off+journalFrameLen+bodyLen]
+		if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(frame[4:]) {
+			break
+		}
+		var rec journalRecord
+		if err = gob.NewDecoder(bytes.NewReader(body)).Decode(&rec); err != nil {
+			break
+		}
+		recs = append(recs, rec)
+		off += journalFrameLen + bodyLen
+	}
+	if len(recs) == 0 || recs[0].Kind != journalStart {
+		return nil, 0, fmt.Errorf("%s: no journal start record", journalPath)
+	}
+	return recs, off, nil
+}
+
+// A ResumePoint tells the caller of ResumeShardedTable where to continue.
+type ResumePoint struct {
+	// InputOffset is the value passed to the last Checkpoint, or 0 if there
+	// was none. Input before it has been ingested, input after it must be
+	// put again.
+	InputOffset uint64
+
+	// Committing is set if the interrupted build had finished ingestion and
+	// was in Commit. The builder then only accepts Commit and Close.
+	Committing bool
+}
+
+// Checkpoint commits the keys put so far to the shard files on stable storage
+// and records them, together with inputOffset, in the journal. inputOffset is
+// opaque to the builder and is returned by ResumeShardedTable, for instance
+// the number of input records or bytes consumed so far. Checkpoint must not
+// be called concurrently with Put, and only on builders created with
+// WithJournal.
+func (b *ShardedBuilder) Checkpoint(inputOffset uint64) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if b.ingested {
+		return errIngested
+	}
+	if b.journal == nil {
+		return fmt.Errorf("builder has no journal")
+	}
+	if err := b.writers.syncAll(); err != nil {
+		return err
+	}
+	err := b.journal.append(&journalRecord{
+		Kind:        journalCheckpoint,
+		InputOffset: inputOffset,
+		Counts:      b.counts,
+	})
+	if err != nil {
+		return err
+	}
+	b.inputOffset = inputOffset
+	return nil
+}
+
+// ResumeShardedTable reopens the builder whose shard directory dirPath holds
+// a journal, as created with WithJournal, after it was interrupted. Keys put
+// after the last checkpoint are dropped from the shard files, and shards
+// that an interrupted Commit already built are not built again. The builder
+// locks dirPath like NewShardedBuilder, but keeps its files. The only
+// ShardOption that applies is WithMaxOpenFiles; the others are taken from the
+// journal.
+func ResumeShardedTable(dirPath string, opts ...ShardOption) (*ShardedBuilder, ResumePoint, error) {
+	journalPath := filepath.Join(dirPath, JournalFileName)
+	recs, validLen, err := readJournal(journalPath)
+	if err != nil {
+		return nil, ResumePoint{}, err
+	}
+	start := recs[0]
+	so := newShardOptions(opts)
+	shardFunc, err := lookupShardFunc(start.ShardFunc)
+	if err != nil {
+		return nil, ResumePoint{}, err
+	}
+	b, err := NewShardedBuilder(
+		start.KeyLen,
+		start.PrefBits,
+		start.BuffSzBytes,
+		dirPath,
+		WithShardFunc(shardFunc),
+		WithMaxOpenFiles(so.maxOpenFiles),
+		WithMaxShardKeys(int(start.MaxShardKeys)),
+		WithDedup(start.Dedup),
+		WithDedupMemory(max(start.DedupMemory, 1)),
+		withResume(),
+	)
+	if err != nil {
+		return nil, ResumePoint{}, err
+	}
+
+	var point ResumePoint
+	built := make([]*journalNode, len(b.counts))
+	for _, rec := range recs[1:] {
+		switch rec.Kind {
+		case journalCheckpoint, journalCommit:
+			if len(rec.Counts) != len(b.counts) {
+				b.lock.unlock()
+				return nil, ResumePoint{}, fmt.Errorf("journal has %d shard counts for %d shards", len(rec.Counts), len(b.counts))
+			}
+			copy(b.counts, rec.Counts)
+			point.InputOffset = rec.InputOffset
+			point.Committing = point.Committing || rec.Kind == journalCommit
+		case journalBuilt:
+			if rec.Shard < 0 || rec.Shard >= len(built) || rec.Tree == nil {
+				b.lock.unlock()
+				return nil, ResumePoint{}, fmt.Errorf("journal has invalid built shard %d", rec.Shard)
+			}
+			built[rec.Shard] = rec.Tree
+		}
+	}
+	if err = b.restoreShardFiles(built); err == nil {
+		err = os.Truncate(journalPath, validLen)
+	}
+	var f *os.File
+	if err == nil {
+		f, err = os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	if err != nil {
+		b.lock.unlock()
+		return nil, ResumePoint{}, err
+	}
+	b.journal = &journal{file: f}
+	b.inputOffset = point.InputOffset
+	b.ingested = point.Committing
+	return b, point, nil
+}
+
+// restoreShardFiles truncates the keys file of every shard that is not built
+// to the keys recorded in the journal, and records the built shards.
+func (b *ShardedBuilder) restoreShardFiles(built []*journalNode) error {
+	for i, cnt := range b.counts {
+		if built[i] != nil {
+			if b.built == nil {
+				b.built = make([]*shardNode, len(b.counts))
+			}
+			b.built[i] = b.fromJournalNode(built[i])
+			continue
+		}
+		tabFilePath := filepath.Join(b.mphDirPath, strconv.Itoa(i)+".bin")
+		stats, err := os.Stat(tabFilePath)
+		if errors.Is(err, os.ErrNotExist) && cnt == 0 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		keysLen := int64(cnt) * int64(b.keyLen)
+		if stats.Size() < keysLen {
+			return fmt.Errorf(
+				"shard %d: keys file holds %d bytes, journal expects %d",
+				i,
+				stats.Size(),
+				keysLen,
+			)
+		}
+		if cnt == 0 {
+			if err = os.Remove(tabFilePath); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = os.Truncate(tabFilePath, keysLen); err != nil {
+			return err
+		}
+		tf := b.writers.newTabFile(tabFilePath)
+		tf.created = true
+		b.writers.files[i] = tf
+	}
+	return nil
+}
+
+func (b *ShardedBuilder) fromJournalNode(jn *journalNode) *shardNode {
+	node := &shardNode{count: jn.Count}
+	if jn.Path != "" {
+		node.path = filepath.Join(b.mphDirPath, jn.Path)
+	}
+	for _, child := range jn.Children {
+		node.children = append(node.children, b.fromJournalNode(child))
+	}
+	return node
+}
+
+func toJournalNode(node *shardNode) *journalNode {
+	jn := &journalNode{Count: node.count}
+	if node.children == nil && node.path != "" {
+		jn.Path = filepath.Base(node.path)
+	}
+	for _, child := range node.children {
+		jn.Children = append(jn.Children, toJournalNode(child))
+	}
+	return jn
+}
+
+// loadBuiltShard loads the tables of the leaves under node, which was built
+// and dumped before the builder was resumed.
+func loadBuiltShard(node *shardNode) error {
+	if node.children == nil {
+		if node.count == 0 {
+			return nil
+		}
+		tblFile, err := os.Open(node.path)
+		if err != nil {
+			return err
+		}
+		if node.table, err = LoadFromKeysFile(tblFile); err != nil {
+			tblFile.Close()
+			return err
+		}
+		return nil
+	}
+	for _, child := range node.children {
+		if err := loadBuiltShard(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishShard dumps the leaves under node, which was just built, and records
+// it in the journal, once they are on stable storage, if b has one. It then
+// removes the keys files of the shards that were split.
+func (b *ShardedBuilder) finishShard(shardIdx int, node *shardNode) error {
+	if b.journal != nil {
+		if err := dumpShardNode(node); err != nil {
+			return err
+		}
+		if err := syncShardNode(node); err != nil {
+			return err
+		}
+		if err := syncDir(b.mphDirPath); err != nil {
+			return err
+		}
+		err := b.journal.append(&journalRecord{
+			Kind:  journalBuilt,
+			Shard: shardIdx,
+			Tree:  toJournalNode(node),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return removeSplitFiles(node)
+}
+
+func dumpShardNode(node *shardNode) error {
+	if node.table != nil {
+		return node.table.DumpToKeysFile()
+	}
+	for _, child := range node.children {
+		if err := dumpShardNode(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncShardNode commits the keys files of the leaves under node to stable
+// storage.
+func syncShardNode(node *shardNode) error {
+	if node.children == nil {
+		if node.path == "" {
+			return nil
+		}
+		return syncFile(node.path)
+	}
+	for _, child := range node.children {
+		if err := syncShardNode(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeSplitFiles removes the keys files of the split shards under node,
+// whose keys have moved to their children.
+func removeSplitFiles(node *shardNode) error {
+	if node.children == nil {
+		return nil
+	}
+	if node.path != "" {
+		if err := os.Remove(node.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	for _, child := range node.children {
+		if err := removeSplitFiles(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package mph
+
+import (
+	"context"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumeShardedTableIngestion(t *testing.T) {
+	keys := sha1Keys(3000)
+	mphDir := t.TempDir()
+	b, err := NewShardedBuilder(sha1.Size, 3, 256, mphDir, WithJournal(), WithMaxOpenFiles(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewShardedBuilder(sha1.Size, 3, 256, mphDir, WithJournal()); err == nil {
+		t.Fatal("second NewShardedBuilder with journal: got nil error; want error")
+	}
+	for i, key := range keys[:2000] {
+		if err = b.Put(key); err != nil {
+			t.Fatal(err)
+		}
+		if i == 999 {
+			if err = b.Checkpoint(1000); err != nil {
+				t.Fatal(err)
+			}
+			// Evicted writers are synced too.
+			for shard, tf := range b.writers.files {
+				if tf != nil && tf.dirty {
+					t.Errorf("shard %d not synced by Checkpoint", shard)
+				}
+			}
+		}
+	}
+	// Simulate a crash after the checkpoint: the keys that followed it reach
+	// the shard files and the journal ends with a torn record.
+	if err = b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	journalFile, err := os.OpenFile(filepath.Join(mphDir, JournalFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journalFile.Write([]byte{42, 0, 0, 0, 1, 2})
+	journalFile.Close()
+
+	b, point, err := ResumeShardedTable(mphDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if point.InputOffset != 1000 || point.Committing {
+		t.Fatalf("ResumePoint: got %+v; want offset 1000 and not committing", point)
+	}
+	var numKeys uint
+	for _, cnt := range b.GetCounts() {
+		numKeys += cnt
+	}
+	if numKeys != 1000 {
+		t.Fatalf("resumed builder holds %d keys; want 1000", numKeys)
+	}
+	for _, key := range keys[1000:] {
+		if err = b.Put(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = b.Checkpoint(3000); err != nil {
+		t.Fatal(err)
+	}
+	st, err := b.Commit(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if got := st.NumKeys(); got != uint64(len(keys)) {
+		t.Errorf("NumKeys: got %d; want %d", got, len(keys))
+	}
+	checkShardedLookups(t, st, keys)
+	if _, err = os.Stat(filepath.Join(mphDir, JournalFileName)); !os.IsNotExist(err) {
+		t.Errorf("journal after Commit: got %v; want it removed", err)
+	}
+}
+
+func TestResumeShardedTableCommit(t *testing.T) {
+	// Shard 3 is split, and fails to build while a directory is in the way
+	// of its first child.
+	keys := sha1Keys(2000)
+	for _, key := range keys[:1000] {
+		key[0] = 3<<5 | key[0]&0x1f
+	}
+	mphDir := t.TempDir()
+	b, err := NewShardedBuilder(sha1.Size, 3, 1024, mphDir, WithJournal(), WithMaxShardKeys(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err = b.Put(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blocker := filepath.Join(mphDir, "3.0.bin")
+	if err = os.Mkdir(blocker, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Commit(context.Background(), 1); err == nil {
+		t.Fatal("Commit: got nil error; want error")
+	}
+	if err = os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+
+	b, point, err := ResumeShardedTable(mphDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !point.Committing {
+		t.Fatalf("ResumePoint: got %+v; want committing", point)
+	}
+	if b.built == nil {
+		t.Error("resumed builder has no built shards")
+	}
+	if err = b.Put(keys[0]); err == nil {
+		t.Error("Put while committing: got nil error; want error")
+	}
+	st, err := b.Commit(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	for shard, cnt := range st.GetCounts() {
+		if cnt > 300 {
+			t.Errorf("shard %d: got %d keys; want <= 300", shard, cnt)
+		}
+	}
+	checkShardedLookups(t, st, keys)
+
+	manifestPath := filepath.Join(mphDir, "sharded.mph")
+	if err = st.DumpToFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadShardedTableFromFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	checkShardedLookups(t, loaded, keys)
+}
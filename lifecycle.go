@@ -0,0 +1,205 @@
+package mph
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LockFileName is the name of the lock file in a shard directory.
+const LockFileName = "mph.lock"
+
+// ErrIndexExists is returned by NewShardedBuilder when the shard directory
+// already holds the files of an index and WithOverwrite is not given.
+var ErrIndexExists = errors.New("mph: shard directory already holds an index")
+
+// ErrLocked is returned when a shard directory is locked by another builder,
+// updater or maintenance function, in this or another process.
+var ErrLocked = errors.New("mph: shard directory is locked")
+
+// A dirLock is an exclusive lock on a shard directory. Locking is advisory
+// and only enforced on Unix systems.
+type dirLock struct {
+	file *os.File
+}
+
+func lockDir(dirPath string) (*dirLock, error) {
+	f, err := os.OpenFile(filepath.Join(dirPath, LockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &dirLock{file: f}, nil
+}
+
+// unlock releases l. The lock file is left in place, so that it cannot be
+// replaced under a process that is about to lock it. DestroyShardedTable is
+// the one exception: it removes the lock file of the index it destroys before
+// unlocking it, and a process waiting on that lock then locks a file that is
+// gone, so the directory must not be in use by anything else.
+func (l *dirLock) unlock() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// isIndexFile reports whether name is that of a file that this package
+// writes to shard directories: shard keys files, including the derived files
+// of split and deduplicated shards, sorted runs and the journal.
+func isIndexFile(name string) bool {
+	return strings.HasSuffix(name, ".bin") || strings.HasSuffix(name, ".run") || name == JournalFileName
+}
+
+// indexFiles returns the paths of the index files in dirPath.
+func indexFiles(dirPath string) ([]string, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && isIndexFile(entry.Name()) {
+			paths = append(paths, filepath.Join(dirPath, entry.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// prepareDir creates the shard directory dirPath of a new builder and locks
+// it. If the directory holds index files, they are removed if overwrite is
+// set and ErrIndexExists is returned otherwise.
+func prepareDir(dirPath string, overwrite bool) (*dirLock, error) {
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := lockDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := indexFiles(dirPath)
+	if err == nil && len(paths) > 0 && !overwrite {
+		err = ErrIndexExists
+	}
+	for _, p := range paths {
+		if err != nil {
+			break
+		}
+		err = os.Remove(p)
+	}
+	if err != nil {
+		lock.unlock()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// openIndex reads the manifest at manifestPath and returns it along with the
+// shard directory and the resolved shard keys file paths of its index. opts
+// are used to resolve the paths of the manifest.
+func openIndex(manifestPath string, opts []LoadOption) (*shardManifest, string, []string, error) {
+	bundled, err := isBundle(manifestPath)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if bundled {
+		return nil, "", nil, fmt.Errorf("%s is a bundle and has no shard directory", manifestPath)
+	}
+	m, err := readManifest(manifestPath)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	lo := newLoadOptions(opts)
+	mphDirPath := resolvePath(lo.resolveBaseDir(manifestPath), m.MphDirPath)
+	return m, mphDirPath, m.resolveTabFilePaths(mphDirPath), nil
+}
+
+// CollectGarbage removes the index files in the shard directory of the table
+// whose manifest is at manifestPath that the manifest does not refer to, and
+// returns their paths. These are left behind by builds with more shards,
+// interrupted builds and updates. The directory must not be shared with
+// another index. opts are used to resolve the paths of the manifest.
+func CollectGarbage(manifestPath string, opts ...LoadOption) ([]string, error) {
+	_, mphDirPath, tabFilePaths, err := openIndex(manifestPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockDir(mphDirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	keep := make(map[string]bool, len(tabFilePaths)+1)
+	for _, p := range append(tabFilePaths, manifestPath) {
+		if absPath, err := filepath.Abs(p); err == nil {
+			keep[absPath] = true
+		}
+	}
+	paths, err := indexFiles(mphDirPath)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	var errs []error
+	for _, p := range paths {
+		absPath, err := filepath.Abs(p)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if keep[absPath] {
+			continue
+		}
+		if err = os.Remove(p); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, p)
+	}
+	return removed, errors.Join(errs...)
+}
+
+// DestroyShardedTable removes the table whose manifest is at manifestPath:
+// its shard keys files, the other index files in its shard directory, the
+// manifest and the lock file. The shard directory is removed too if nothing
+// else is left in it. No other process may be using the table, as the lock
+// file is removed too. opts are used to resolve the paths of the manifest.
+func DestroyShardedTable(manifestPath string, opts ...LoadOption) error {
+	_, mphDirPath, tabFilePaths, err := openIndex(manifestPath, opts)
+	if err != nil {
+		return err
+	}
+	lock, err := lockDir(mphDirPath)
+	if err != nil {
+		return err
+	}
+	paths, err := indexFiles(mphDirPath)
+	if err != nil {
+		lock.unlock()
+		return err
+	}
+	var errs []error
+	for _, p := range append(append(tabFilePaths, paths...), manifestPath) {
+		if p == "" {
+			continue
+		}
+		if err = os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	if err = errors.Join(errs...); err != nil {
+		lock.unlock()
+		return err
+	}
+	// Removed under the lock; see dirLock.unlock.
+	os.Remove(filepath.Join(mphDirPath, LockFileName))
+	lock.unlock()
+	os.Remove(mphDirPath)
+	return nil
+}
@@ -0,0 +1,103 @@
+package mph
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestNewShardedBuilderExistingIndex(t *testing.T) {
+	keys := sha1Keys(500)
+	mphDir := t.TempDir()
+	st := buildShardedTable(t, mphDir, keys, 3)
+	st.Close()
+
+	if _, err := NewShardedBuilder(sha1.Size, 2, 1024, mphDir); err != ErrIndexExists {
+		t.Fatalf("NewShardedBuilder over an index: got %v; want ErrIndexExists", err)
+	}
+	st = buildShardedTable(t, mphDir, keys, 2, WithOverwrite())
+	defer st.Close()
+	checkShardedLookups(t, st, keys)
+	for _, name := range shardDirEntries(t, mphDir) {
+		if !slices.Contains([]string{"0.bin", "1.bin", "2.bin", "3.bin"}, name) {
+			t.Errorf("file %s left over from the previous build", name)
+		}
+	}
+}
+
+func TestNewShardedBuilderLocked(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shard directories are not locked on Windows")
+	}
+	mphDir := t.TempDir()
+	b, err := NewShardedBuilder(sha1.Size, 2, 1024, mphDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewShardedBuilder(sha1.Size, 2, 1024, mphDir); err != ErrLocked {
+		t.Errorf("second NewShardedBuilder: got %v; want ErrLocked", err)
+	}
+	if err = b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err = NewShardedBuilder(sha1.Size, 2, 1024, mphDir)
+	if err != nil {
+		t.Fatalf("NewShardedBuilder after Close: %v", err)
+	}
+	b.Close()
+}
+
+func TestCollectGarbage(t *testing.T) {
+	keys := sha1Keys(500)
+	mphDir := t.TempDir()
+	manifestPath := filepath.Join(mphDir, "sharded.mph")
+	st := buildShardedTable(t, mphDir, keys, 3)
+	st.Close()
+	st = buildShardedTable(t, mphDir, keys, 2, WithOverwrite())
+	if err := st.DumpToFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	stale := []string{filepath.Join(mphDir, "7.bin"), filepath.Join(mphDir, "sort.0.run")}
+	for _, p := range stale {
+		if err := os.WriteFile(p, []byte("stale"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := CollectGarbage(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(removed)
+	if !slices.Equal(removed, stale) {
+		t.Errorf("CollectGarbage: got %v; want %v", removed, stale)
+	}
+	loaded, err := LoadShardedTableFromFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	checkShardedLookups(t, loaded, keys)
+}
+
+func TestDestroyShardedTable(t *testing.T) {
+	keys := sha1Keys(500)
+	mphDir := filepath.Join(t.TempDir(), "index")
+	manifestPath := filepath.Join(mphDir, "sharded.mph")
+	st := buildShardedTable(t, mphDir, keys, 3)
+	if err := st.DumpToFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+
+	if err := DestroyShardedTable(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(mphDir); !os.IsNotExist(err) {
+		t.Errorf("shard dir after DestroyShardedTable: got %v; want it removed", err)
+	}
+}
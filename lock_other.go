@@ -0,0 +1,15 @@
+//go:build !unix
+
+package mph
+
+import "os"
+
+// lockFile does nothing: shard directories are only locked on Unix systems.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// syncDir does nothing: directories can only be synced on Unix systems.
+func syncDir(dirPath string) error {
+	return nil
+}
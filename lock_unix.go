@@ -0,0 +1,24 @@
+//go:build unix
+
+package mph
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on f without waiting, returning ErrLocked
+// if another open file holds it.
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrLocked
+	}
+	return err
+}
+
+// syncDir commits the entries of directory dirPath to stable storage.
+func syncDir(dirPath string) error {
+	return syncFile(dirPath)
+}
@@ -0,0 +1,221 @@
+package mph
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// mergeBuffSzBytes bounds the shard write buffers of the builders used by
+// MergeShardedTables and Reshard.
+const mergeBuffSzBytes = 64 << 20
+
+// MergeShardedTables builds the union of the keys of a and b into a new table
+// whose shard files are written to outDir, which must not be the shard
+// directory of a or b. Keys present in both tables are kept once, as with
+// WithDedup(DedupDrop), which overrides any dedup mode given in opts. The
+// tables must have the same key length but may use different prefBits and
+// ShardFuncs: the merged table has the larger prefBits of the two and, unless
+// overridden by opts, the ShardFunc of a. The shard files of an input with
+// the prefBits and ShardFunc of the merged table are copied to the merged
+// shards as they are; the keys of the other input are redistributed. Input
+// shards are read and merged shards are built in parallel. The merged table
+// can be dumped with DumpToFile or DumpToBundle.
+func MergeShardedTables(a, b *ShardedReader, outDir string, opts ...ShardOption) (*ShardedReader, error) {
+	if a.closed || b.closed {
+		return nil, ErrClosed
+	}
+	if a.keyLen != b.keyLen {
+		return nil, fmt.Errorf("cannot merge tables of %d and %d byte keys", a.keyLen, b.keyLen)
+	}
+	if err := checkOutDir(outDir, a, b); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+	opts = append([]ShardOption{WithShardFunc(a.shardFunc)}, opts...)
+	opts = append(opts, WithDedup(DedupDrop))
+	builder, err := NewShardedBuilder(
+		a.keyLen,
+		max(a.prefBits, b.prefBits),
+		mergeBuffSzBytes,
+		outDir,
+		opts...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var grp errgroup.Group
+	grp.SetLimit(runtime.GOMAXPROCS(0))
+	for _, r := range []*ShardedReader{a, b} {
+		sameShards := r.prefBits == builder.prefBits && r.shardFunc.Name() == builder.shardFunc.Name()
+		if sameShards && builder.runs == nil {
+			r.copyShards(&grp, builder, func(shardIdx uint64) uint64 { return shardIdx })
+		} else {
+			r.putKeys(&grp, builder)
+		}
+	}
+	if err = grp.Wait(); err != nil {
+		builder.rollback(nil)
+		return nil, err
+	}
+	return builder.Commit(context.Background(), 0)
+}
+
+// checkOutDir returns an error if outDir is the shard directory of any of rs,
+// whose files a builder writing to outDir would remove.
+func checkOutDir(outDir string, rs ...*ShardedReader) error {
+	outInfo, err := os.Stat(outDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, r := range rs {
+		if r.bundleFile != nil {
+			continue
+		}
+		info, err := os.Stat(r.mphDirPath)
+		if err == nil && os.SameFile(info, outInfo) {
+			return fmt.Errorf("%s is the shard directory of an input table", outDir)
+		}
+	}
+	return nil
+}
+
+// Reshard redistributes the keys of r over 2^newPrefBits shards, written to
+// mphDirPath, which must not be the shard directory of r, and dumps the
+// resulting table to manifestPath. The keys are read from the shard files of
+// r, so the original input is not needed. The returned table uses the
+// ShardFunc of r. With a built-in ShardMode, every new shard holds the keys
+// of one or more whole old shards, or of part of one: fewer shards are made
+// by concatenating the old shard files, and more by streaming every old shard
+// file into the new shards it is split into.
+func (r *ShardedReader) Reshard(newPrefBits int, mphDirPath, manifestPath string) (*ShardedReader, error) {
+	if r.closed {
+		return nil, ErrClosed
+	}
+	if err := checkOutDir(mphDirPath, r); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(mphDirPath, 0755); err != nil {
+		return nil, err
+	}
+	builder, err := NewShardedBuilder(
+		r.keyLen,
+		newPrefBits,
+		mergeBuffSzBytes,
+		mphDirPath,
+		WithShardFunc(r.shardFunc),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var grp errgroup.Group
+	grp.SetLimit(runtime.GOMAXPROCS(0))
+	if mode, ok := r.shardFunc.(ShardMode); ok && newPrefBits <= r.prefBits {
+		r.copyShards(&grp, builder, func(shardIdx uint64) uint64 {
+			return mode.parentShard(shardIdx, r.prefBits, newPrefBits)
+		})
+	} else {
+		r.putKeys(&grp, builder)
+	}
+	if err = grp.Wait(); err != nil {
+		builder.rollback(nil)
+		return nil, err
+	}
+	resharded, err := builder.Commit(context.Background(), 0)
+	if err != nil {
+		return nil, err
+	}
+	if err = resharded.DumpToFile(manifestPath); err != nil {
+		resharded.Close()
+		return nil, err
+	}
+	return resharded, nil
+}
+
+// putKeys schedules on grp the reading of every shard of r into builder.
+func (r *ShardedReader) putKeys(grp *errgroup.Group, builder *ShardedBuilder) {
+	for i, cnt := range r.counts {
+		if cnt == 0 {
+			continue
+		}
+		grp.Go(func() error {
+			return r.forEachShardKey(uint64(i), builder.Put)
+		})
+	}
+}
+
+// copyShards schedules on grp the copying of the keys of every top-level
+// shard i of r to shard target(i) of builder, which must hold all the keys of
+// shard i.
+func (r *ShardedReader) copyShards(grp *errgroup.Group, builder *ShardedBuilder, target func(uint64) uint64) {
+	for i := range uint64(1) << r.prefBits {
+		grp.Go(func() error {
+			for _, shardIdx := range r.leafShards(i) {
+				if r.counts[shardIdx] == 0 {
+					continue
+				}
+				src, closeSrc, err := r.openShardKeys(shardIdx)
+				if err != nil {
+					return err
+				}
+				err = builder.putShardKeys(target(i), src, r.counts[shardIdx])
+				closeSrc()
+				if err != nil {
+					return fmt.Errorf("shard %d: %v", shardIdx, err)
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// forEachShardKey calls f with every key of shard shardIdx, read from its
+// keys file or bundle region. The key passed to f is only valid during the
+// call.
+func (r *ShardedReader) forEachShardKey(shardIdx uint64, f func(key []byte) error) error {
+	src, closeSrc, err := r.openShardKeys(shardIdx)
+	if err != nil {
+		return err
+	}
+	defer closeSrc()
+	buff := bufio.NewReader(src)
+	key := make([]byte, r.keyLen)
+	for {
+		if _, err := io.ReadFull(buff, key); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("shard %d: %v", shardIdx, err)
+		}
+		if err := f(key); err != nil {
+			return err
+		}
+	}
+}
+
+// openShardKeys returns a reader of the keys of shard shardIdx, without the
+// footer of its keys file, and a function that releases it.
+func (r *ShardedReader) openShardKeys(shardIdx uint64) (io.Reader, func(), error) {
+	keysLen := int64(r.counts[shardIdx]) * int64(r.keyLen)
+	if r.bundleFile != nil {
+		region := r.bundleRegions[shardIdx]
+		return io.NewSectionReader(r.bundleFile, region.Off, keysLen), func() {}, nil
+	}
+	tblFile, err := os.Open(r.tabFilePaths[shardIdx])
+	if err != nil {
+		return nil, nil, fmt.Errorf("shard %d: %v", shardIdx, err)
+	}
+	return io.LimitReader(tblFile, keysLen), func() { tblFile.Close() }, nil
+}
@@ -0,0 +1,128 @@
+package mph
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestMergeShardedTables(t *testing.T) {
+	keys := sha1Keys(3000)
+	dir := t.TempDir()
+	a := buildShardedTable(t, filepath.Join(dir, "a"), keys[:2000], 3)
+	b := buildShardedTable(t, filepath.Join(dir, "b"), keys[1000:], 5, WithShardMode(ShardByHash))
+	bundlePath := filepath.Join(dir, "b.bundle")
+	if err := b.DumpToBundle(bundlePath); err != nil {
+		t.Fatal(err)
+	}
+	bundled, err := LoadShardedTableFromFile(bundlePath, WithLazyLoading(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Split shards of the same prefBits and ShardFunc as the merged table.
+	split := buildShardedTable(t, filepath.Join(dir, "split"), keys[1000:], 5, WithMaxShardKeys(40))
+	if split.roots == nil {
+		t.Fatal("no shard was split")
+	}
+
+	for _, tc := range []struct {
+		name string
+		b    *ShardedReader
+	}{
+		{"files", b},
+		{"bundle", bundled},
+		{"split", split},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			outDir := filepath.Join(t.TempDir(), "merged")
+			merged, err := MergeShardedTables(a, tc.b, outDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer merged.Close()
+			if got := merged.NumKeys(); got != uint64(len(keys)) {
+				t.Errorf("NumKeys: got %d; want %d", got, len(keys))
+			}
+			if got := len(merged.GetCounts()); got != 1<<5 {
+				t.Errorf("got %d shards; want %d", got, 1<<5)
+			}
+			if merged.shardFunc.Name() != ShardByPrefix.Name() {
+				t.Errorf("shard func: got %q; want %q", merged.shardFunc.Name(), ShardByPrefix.Name())
+			}
+			checkShardedLookups(t, merged, keys)
+
+			manifestPath := filepath.Join(outDir, "merged.mph")
+			if err = merged.DumpToFile(manifestPath); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := LoadShardedTableFromFile(manifestPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer loaded.Close()
+			checkShardedLookups(t, loaded, keys)
+		})
+	}
+}
+
+func TestMergeShardedTablesOutDir(t *testing.T) {
+	dir := t.TempDir()
+	a := buildShardedTable(t, filepath.Join(dir, "a"), sha1Keys(100), 2)
+	b := buildShardedTable(t, filepath.Join(dir, "b"), sha1Keys(200)[100:], 2)
+	if _, err := MergeShardedTables(a, b, filepath.Join(dir, "b"), WithOverwrite()); err == nil {
+		t.Fatal("MergeShardedTables into the shard directory of b: got nil error; want error")
+	}
+	for _, tabFilePath := range b.tabFilePaths {
+		if _, err := os.Stat(tabFilePath); err != nil {
+			t.Errorf("shard file of b: %v", err)
+		}
+	}
+}
+
+func TestMergeShardedTablesKeyLen(t *testing.T) {
+	dir := t.TempDir()
+	a := buildShardedTable(t, filepath.Join(dir, "a"), sha1Keys(100), 2)
+	b := buildShardedTable(t, filepath.Join(dir, "b"), [][]byte{[]byte("abcd"), []byte("efgh")}, 2)
+	if _, err := MergeShardedTables(a, b, filepath.Join(dir, "merged")); err == nil {
+		t.Error("MergeShardedTables with different key lengths: got nil error; want error")
+	}
+}
+
+func TestReshard(t *testing.T) {
+	keys := sha1Keys(3000)
+	for _, mode := range []ShardMode{ShardByPrefix, ShardByHash} {
+		dir := t.TempDir()
+		st := buildShardedTable(t, filepath.Join(dir, "shards"), keys, 10, WithShardMode(mode))
+		for _, newPrefBits := range []int{2, 9, 10, 12} {
+			mphDir := filepath.Join(dir, "resharded"+strconv.Itoa(newPrefBits))
+			manifestPath := mphDir + ".mph"
+			resharded, err := st.Reshard(newPrefBits, mphDir, manifestPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(resharded.GetCounts()); got != 1<<newPrefBits {
+				t.Errorf("got %d shards; want %d", got, 1<<newPrefBits)
+			}
+			checkShardedLookups(t, resharded, keys)
+			resharded.Close()
+
+			loaded, err := LoadShardedTableFromFile(manifestPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := loaded.NumKeys(); got != uint64(len(keys)) {
+				t.Errorf("NumKeys: got %d; want %d", got, len(keys))
+			}
+			if loaded.shardFunc.Name() != mode.Name() {
+				t.Errorf("shard func: got %q; want %q", loaded.shardFunc.Name(), mode.Name())
+			}
+			checkShardedLookups(t, loaded, keys)
+			loaded.Close()
+		}
+
+		if _, err := st.Reshard(4, filepath.Join(dir, "shards"), filepath.Join(dir, "x.mph")); err == nil {
+			t.Error("Reshard into the shard directory of the table: got nil error; want error")
+		}
+	}
+}
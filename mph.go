@@ -5,29 +5,46 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"os"
+	"path/filepath"
 	"sort"
+	"time"
+	"unsafe"
 )
 
+// ErrClosed is returned when a Table, ShardedBuilder, ShardedReader or Reloader
+// is used after Close.
+var ErrClosed = errors.New("mph: table is closed")
+
 // A Table is an immutable hash table that provides constant-time lookups of key
 // indices using a minimal perfect hash.
 type Table struct {
 	keysFile   *os.File
+	keysOff    int64 // offset of the first key in keysFile
+	bundled    bool  // keysFile is a bundle shared with other tables
 	keyLen     int
 	keys       [][]byte
 	level0     []uint32 // power of 2 size
 	level0Mask int      // len(Level0) - 1
 	level1     []uint32 // power of 2 size >= len(keys)
 	level1Mask int      // len(Level1) - 1
+	numKeys    int
+	closed     bool
+
+	// Recorded by Build and BuildFromFile only; see Stats.
+	buildTime   time.Duration
+	bucketSizes []int
 }
 
 // Build builds a Table from keys using the "Hash, displace, and compress"
 // algorithm described in http://cmph.sourceforge.net/papers/esa09.pdf.
 // Returns an error if duplicate keys are detected.
 func Build(keys [][]byte) (*Table, error) {
+	start := time.Now()
 	var (
 		level0        = make([]uint32, nextPow2(len(keys)/4))
 		level0Mask    = len(level0) - 1
@@ -76,16 +93,23 @@ func Build(keys [][]byte) (*Table, error) {
 	}
 
 	return &Table{
-		keys:       keys,
-		keyLen:     len(keys),
-		level0:     level0,
-		level0Mask: level0Mask,
-		level1:     level1,
-		level1Mask: level1Mask,
+		keys:        keys,
+		keyLen:      len(keys),
+		level0:      level0,
+		level0Mask:  level0Mask,
+		level1:      level1,
+		level1Mask:  level1Mask,
+		numKeys:     len(keys),
+		buildTime:   time.Since(start),
+		bucketSizes: bucketSizeHistogram(buckets, len(level0)),
 	}, nil
 }
 
+// BuildFromFile builds a Table from the keys of length keyLen stored back to
+// back in keysFile. The table keeps reading keys from keysFile during lookups
+// and closes it on Close.
 func BuildFromFile(keysFile *os.File, keyLen int) (*Table, error) {
+	start := time.Now()
 	numKeys, err := getNumKeys(keysFile, keyLen)
 	if err != nil {
 		return nil, err
@@ -100,13 +124,9 @@ func BuildFromFile(keysFile *os.File, keyLen int) (*Table, error) {
 		zeroSeed      = murmurSeed(0)
 	)
 
-	for i := 0; ; i++ {
+	for i := 0; i < int(numKeys); i++ {
 		key := make([]byte, keyLen)
-		_, err = io.ReadFull(keysFile, key)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
+		if _, err = io.ReadFull(keysFile, key); err != nil {
 			return nil, err
 		}
 		n := int(zeroSeed.hash(key)) & level0Mask
@@ -159,21 +179,69 @@ func BuildFromFile(keysFile *os.File, keyLen int) (*Table, error) {
 	}
 
 	return &Table{
-		keysFile:   keysFile,
-		keyLen:     keyLen,
-		level0:     level0,
-		level0Mask: level0Mask,
-		level1:     level1,
-		level1Mask: level1Mask,
+		keysFile:    keysFile,
+		keyLen:      keyLen,
+		level0:      level0,
+		level0Mask:  level0Mask,
+		level1:      level1,
+		level1Mask:  level1Mask,
+		numKeys:     int(numKeys),
+		buildTime:   time.Since(start),
+		bucketSizes: bucketSizeHistogram(buckets, len(level0)),
 	}, nil
 }
 
+// keysFileMagic terminates the footer written by DumpToKeysFile, which lets a
+// keys file that already carries a footer be recognized.
+var keysFileMagic = [8]byte{'M', 'P', 'H', 'K', 'E', 'Y', 'S', '1'}
+
+// keysTrailerLen is the size of the fixed-length tail of a keys file footer:
+// key length, key count and magic.
+const keysTrailerLen = 16
+
+// readKeysTrailer reads the trailer of a keys file of the given size. ok is
+// false if the file does not end with a footer written by DumpToKeysFile.
+func readKeysTrailer(r io.ReaderAt, size int64) (keyLen, numKeys uint32, ok bool, err error) {
+	if size < keysTrailerLen {
+		return 0, 0, false, nil
+	}
+	buff := make([]byte, keysTrailerLen)
+	if _, err = r.ReadAt(buff, size-keysTrailerLen); err != nil {
+		return 0, 0, false, err
+	}
+	if !bytes.Equal(buff[8:], keysFileMagic[:]) {
+		return 0, 0, false, nil
+	}
+	keyLen = binary.LittleEndian.Uint32(buff[:4])
+	numKeys = binary.LittleEndian.Uint32(buff[4:8])
+	if keyLen == 0 || int64(numKeys)*int64(keyLen)+keysTrailerLen > size {
+		return 0, 0, false, fmt.Errorf("corrupt keys file footer")
+	}
+	return keyLen, numKeys, true, nil
+}
+
+// getNumKeys returns the number of keys stored in keysFile, ignoring a
+// footer if one is present.
 func getNumKeys(keysFile *os.File, keyLen int) (int64, error) {
 	keysFileStats, err := keysFile.Stat()
 	if err != nil {
 		return 0, err
 	}
 	keysFileLen := keysFileStats.Size()
+	footerKeyLen, numKeys, ok, err := readKeysTrailer(keysFile, keysFileLen)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		if int(footerKeyLen) != keyLen {
+			return 0, fmt.Errorf(
+				"keys file footer key length (%d) does not match key length (%d)",
+				footerKeyLen,
+				keyLen,
+			)
+		}
+		return int64(numKeys), nil
+	}
 	if keysFileLen%int64(keyLen) != 0 {
 		return 0, fmt.Errorf(
 			"keys file length (%d) is not a multiple of key length (%d)",
@@ -184,25 +252,22 @@ func getNumKeys(keysFile *os.File, keyLen int) (int64, error) {
 	return keysFileLen / int64(keyLen), nil
 }
 
-func keyAtIdx(keysFile *os.File, idx, keyLen int) ([]byte, error) {
-	if _, err := keysFile.Seek(int64(idx*keyLen), 0); err != nil {
-		return nil, err
-	}
+func keyAtIdx(keysFile io.ReaderAt, base int64, idx, keyLen int) ([]byte, error) {
 	key := make([]byte, keyLen)
-	if _, err := io.ReadFull(keysFile, key); err != nil {
+	if _, err := keysFile.ReadAt(key, base+int64(idx)*int64(keyLen)); err != nil {
 		return nil, err
 	}
 	return key, nil
 }
 
 func keysAtIndexes(
-	keysFile *os.File,
+	keysFile io.ReaderAt,
 	bucketKeys [][]byte,
 	keyLen int,
 	indexes ...int,
 ) error {
 	for i, idx := range indexes {
-		key, err := keyAtIdx(keysFile, idx, keyLen)
+		key, err := keyAtIdx(keysFile, 0, idx, keyLen)
 		if err != nil {
 			return err
 		}
@@ -220,19 +285,59 @@ func nextPow2(n int) int {
 }
 
 // Lookup searches for s in t and returns its index and whether it was found.
+// Lookups on a closed table always fail.
 func (t *Table) Lookup(s []byte) (n uint32, ok bool) {
+	if t.closed {
+		return 0, false
+	}
 	if t.keys != nil {
 		return t.lookupInMem(s)
 	}
 	return t.lookupFromFile(s)
 }
 
+// Close releases the keys file backing t, unless it is shared with other
+// tables through a bundle. It returns ErrClosed if t is already closed.
+func (t *Table) Close() error {
+	if t.closed {
+		return ErrClosed
+	}
+	t.closed = true
+	t.keys = nil
+	t.level0 = nil
+	t.level1 = nil
+	if t.keysFile != nil && !t.bundled {
+		return t.keysFile.Close()
+	}
+	return nil
+}
+
+// SizeInBytes returns the approximate amount of memory held by t. Keys that
+// are read from a file are not included.
+func (t *Table) SizeInBytes() int64 {
+	size := int64(unsafe.Sizeof(*t))
+	size += 4 * int64(cap(t.level0)+cap(t.level1))
+	size += int64(unsafe.Sizeof([]byte(nil))) * int64(cap(t.keys))
+	for _, key := range t.keys {
+		size += int64(cap(key))
+	}
+	return size
+}
+
+// OpenFiles returns the number of file descriptors held open by t.
+func (t *Table) OpenFiles() int {
+	if t.closed || t.keysFile == nil || t.bundled {
+		return 0
+	}
+	return 1
+}
+
 func (t *Table) lookupFromFile(s []byte) (n uint32, ok bool) {
 	i0 := int(murmurSeed(0).hash(s)) & t.level0Mask
 	seed := t.level0[i0]
 	i1 := int(murmurSeed(seed).hash(s)) & t.level1Mask
 	n = t.level1[i1]
-	key, err := keyAtIdx(t.keysFile, int(n), t.keyLen)
+	key, err := keyAtIdx(t.keysFile, t.keysOff, int(n), t.keyLen)
 	if err != nil {
 		return 0, false
 	}
@@ -247,52 +352,59 @@ func (t *Table) lookupInMem(s []byte) (n uint32, ok bool) {
 	return n, bytes.Equal(s, t.keys[int(n)])
 }
 
+// DumpToKeysFile appends the table to the keys file it was built from, so that
+// it can later be restored with LoadFromKeysFile. A footer left by a previous
+// dump is replaced, which makes repeated calls safe.
 func (t *Table) DumpToKeysFile() error {
+	if t.closed {
+		return ErrClosed
+	}
 	if t.keysFile == nil {
 		return fmt.Errorf("keys file not set")
 	}
+	if t.bundled {
+		return fmt.Errorf("table is part of a bundle")
+	}
 	numKeys, err := getNumKeys(t.keysFile, t.keyLen)
 	if err != nil {
 		return fmt.Errorf("error fetching key count: %v", err)
 	}
-	if err = t.keysFile.Close(); err != nil {
-		return err
-	}
 
-	t.keysFile, err = os.OpenFile(
-		t.keysFile.Name(),
-		os.O_WRONLY|os.O_APPEND,
-		0644,
-	)
+	footerFile, err := os.OpenFile(t.keysFile.Name(), os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
-
-	encoder := gob.NewEncoder(t.keysFile)
-	if err = encoder.Encode(t.level0); err != nil {
+	defer footerFile.Close()
+	if err = footerFile.Truncate(numKeys * int64(t.keyLen)); err != nil {
 		return err
 	}
-	if err = encoder.Encode(t.level0Mask); err != nil {
+	if _, err = footerFile.Seek(0, io.SeekEnd); err != nil {
 		return err
 	}
-	if err = encoder.Encode(t.level1); err != nil {
+
+	if err = t.encodeLevels(footerFile); err != nil {
 		return err
 	}
-	if err = encoder.Encode(t.level1Mask); err != nil {
+	err = binary.Write(footerFile, binary.LittleEndian, uint32(t.keyLen))
+	if err != nil {
 		return err
 	}
-	err = binary.Write(t.keysFile, binary.LittleEndian, uint32(t.keyLen))
+	err = binary.Write(footerFile, binary.LittleEndian, uint32(numKeys))
 	if err != nil {
 		return err
 	}
-	err = binary.Write(t.keysFile, binary.LittleEndian, uint32(numKeys))
-	if err != nil {
+	if _, err = footerFile.Write(keysFileMagic[:]); err != nil {
 		return err
 	}
-	return t.keysFile.Close()
+	return footerFile.Close()
 }
 
+// DumpToFile writes t to filePath. The path of a backing keys file is stored
+// relative to the directory of filePath, so the two can be moved together.
 func (t *Table) DumpToFile(filePath string) error {
+	if t.closed {
+		return ErrClosed
+	}
 	dumpFile, err := os.OpenFile(
 		filePath,
 		os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
@@ -302,13 +414,13 @@ func (t *Table) DumpToFile(filePath string) error {
 		return err
 	}
 	encoder := gob.NewEncoder(dumpFile)
-	if err = t.encode(encoder); err != nil {
+	if err = t.encode(encoder, filepath.Dir(filePath)); err != nil {
 		return err
 	}
 	return dumpFile.Close()
 }
 
-func (t *Table) encode(encoder *gob.Encoder) (err error) {
+func (t *Table) encode(encoder *gob.Encoder, baseDir string) (err error) {
 	if t.keys != nil {
 		if err = encoder.Encode(0); err != nil {
 			return err
@@ -317,11 +429,18 @@ func (t *Table) encode(encoder *gob.Encoder) (err error) {
 			return err
 		}
 	}
+	if t.bundled {
+		return fmt.Errorf("table is part of a bundle")
+	}
 	if t.keysFile != nil {
 		if err = encoder.Encode(1); err != nil {
 			return err
 		}
-		if err = encoder.Encode(t.keysFile.Name()); err != nil {
+		keysFilePath, err := relPath(baseDir, t.keysFile.Name())
+		if err != nil {
+			return err
+		}
+		if err = encoder.Encode(keysFilePath); err != nil {
 			return err
 		}
 	}
@@ -343,63 +462,119 @@ func (t *Table) encode(encoder *gob.Encoder) (err error) {
 	return
 }
 
+// LoadFromKeysFile restores a table from a keys file written by
+// DumpToKeysFile. Footers written before the trailing magic was introduced
+// are still accepted.
 func LoadFromKeysFile(keysFile *os.File) (*Table, error) {
-	_, err := keysFile.Seek(-8, 2)
+	keysFileStats, err := keysFile.Stat()
 	if err != nil {
 		return nil, err
 	}
-	buff := make([]byte, 8)
-	_, err = io.ReadFull(keysFile, buff)
+	keyLen, numKeys, ok, err := readKeysTrailer(keysFile, keysFileStats.Size())
 	if err != nil {
 		return nil, err
 	}
+	if !ok {
+		keyLen, numKeys, err = readLegacyKeysTrailer(keysFile)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	var numKeys, keyLen uint32
-	_, err = binary.Decode(buff[4:], binary.LittleEndian, &numKeys)
-	if err != nil {
+	t := Table{keysFile: keysFile, keyLen: int(keyLen), numKeys: int(numKeys)}
+	keysLen := int64(numKeys) * int64(keyLen)
+	footer := io.NewSectionReader(keysFile, keysLen, keysFileStats.Size()-keysLen)
+	if err = t.decodeLevels(footer); err != nil {
 		return nil, err
 	}
+	return &t, nil
+}
 
-	_, err = binary.Decode(buff[:4], binary.LittleEndian, &keyLen)
+// loadFromKeysRegion restores a table from the region [off, off+size) of f,
+// which must hold a keys file written by DumpToKeysFile. The table reads its
+// keys from f in place.
+func loadFromKeysRegion(f *os.File, off, size int64) (*Table, error) {
+	keyLen, numKeys, ok, err := readKeysTrailer(io.NewSectionReader(f, off, size), size)
 	if err != nil {
 		return nil, err
 	}
-
-	t := Table{keysFile: keysFile, keyLen: int(keyLen)}
-	_, err = keysFile.Seek(int64(numKeys)*int64(t.keyLen), 0)
-	if err != nil {
+	if !ok {
+		return nil, fmt.Errorf("keys region at offset %d has no footer", off)
+	}
+	t := Table{
+		keysFile: f,
+		keysOff:  off,
+		bundled:  true,
+		keyLen:   int(keyLen),
+		numKeys:  int(numKeys),
+	}
+	keysLen := int64(numKeys) * int64(keyLen)
+	if err = t.decodeLevels(io.NewSectionReader(f, off+keysLen, size-keysLen)); err != nil {
 		return nil, err
 	}
+	return &t, nil
+}
+
+func (t *Table) encodeLevels(w io.Writer) error {
+	encoder := gob.NewEncoder(w)
+	if err := encoder.Encode(t.level0); err != nil {
+		return err
+	}
+	if err := encoder.Encode(t.level0Mask); err != nil {
+		return err
+	}
+	if err := encoder.Encode(t.level1); err != nil {
+		return err
+	}
+	return encoder.Encode(t.level1Mask)
+}
 
-	gobDecoder := gob.NewDecoder(keysFile)
+func (t *Table) decodeLevels(r io.Reader) (err error) {
+	gobDecoder := gob.NewDecoder(r)
 	if err = gobDecoder.Decode(&t.level0); err != nil {
-		return nil, err
+		return err
 	}
 	if err = gobDecoder.Decode(&t.level0Mask); err != nil {
-		return nil, err
+		return err
 	}
 	if err = gobDecoder.Decode(&t.level1); err != nil {
-		return nil, err
+		return err
 	}
 	if err = gobDecoder.Decode(&t.level1Mask); err != nil {
-		return nil, err
+		return err
 	}
+	return nil
+}
 
-	return &t, nil
+func readLegacyKeysTrailer(keysFile *os.File) (keyLen, numKeys uint32, err error) {
+	if _, err = keysFile.Seek(-8, 2); err != nil {
+		return 0, 0, err
+	}
+	buff := make([]byte, 8)
+	if _, err = io.ReadFull(keysFile, buff); err != nil {
+		return 0, 0, err
+	}
+	keyLen = binary.LittleEndian.Uint32(buff[:4])
+	numKeys = binary.LittleEndian.Uint32(buff[4:])
+	return keyLen, numKeys, nil
 }
 
-func LoadFromFile(filePath string) (*Table, error) {
+// LoadFromFile restores a table written by DumpToFile. A relative keys file
+// path is resolved against the directory of filePath unless overridden with
+// WithBaseDir.
+func LoadFromFile(filePath string, opts ...LoadOption) (*Table, error) {
 	dumpFile, err := os.Open(filePath)
 	if err != nil {
 		return nil, err
 	}
 	defer dumpFile.Close()
 
+	lo := newLoadOptions(opts)
 	gobDecoder := gob.NewDecoder(dumpFile)
-	return decode(gobDecoder)
+	return decode(gobDecoder, lo.resolveBaseDir(filePath))
 }
 
-func decode(gobDecoder *gob.Decoder) (*Table, error) {
+func decode(gobDecoder *gob.Decoder, baseDir string) (*Table, error) {
 	var t Table
 	var err error
 	var tag int
@@ -416,7 +591,7 @@ func decode(gobDecoder *gob.Decoder) (*Table, error) {
 		if err = gobDecoder.Decode(&keysFilePath); err != nil {
 			return nil, err
 		}
-		t.keysFile, err = os.Open(keysFilePath)
+		t.keysFile, err = os.Open(resolvePath(baseDir, keysFilePath))
 		if err != nil {
 			return nil, err
 		}
@@ -436,6 +611,14 @@ func decode(gobDecoder *gob.Decoder) (*Table, error) {
 	if err = gobDecoder.Decode(&t.level1Mask); err != nil {
 		return nil, err
 	}
+	t.numKeys = len(t.keys)
+	if t.keysFile != nil {
+		numKeys, err := getNumKeys(t.keysFile, t.keyLen)
+		if err != nil {
+			return nil, err
+		}
+		t.numKeys = int(numKeys)
+	}
 	return &t, nil
 }
 
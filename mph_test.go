@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"crypto/sha1"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"testing"
@@ -150,6 +151,143 @@ func TestBuildFromFile(t *testing.T) {
 	}
 }
 
+func TestDumpToKeysFile_idempotent(t *testing.T) {
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		sum := sha1.Sum([]byte("key" + strconv.Itoa(i)))
+		keys[i] = sum[:]
+	}
+	keysFilePath := writeKeysFile(t, keys)
+
+	keysFile, err := os.Open(keysFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keysFile.Close()
+	tbl, err := BuildFromFile(keysFile, sha1.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = tbl.DumpToKeysFile(); err != nil {
+			t.Fatalf("DumpToKeysFile #%d: %v", i+1, err)
+		}
+	}
+	if n, err := getNumKeys(keysFile, sha1.Size); err != nil || n != int64(len(keys)) {
+		t.Fatalf("getNumKeys: got (%d, %v); want (%d, nil)", n, err, len(keys))
+	}
+
+	// Rebuilding from a keys file that already carries a footer must ignore it.
+	rebuildFile, err := os.Open(keysFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rebuildFile.Close()
+	if _, err = BuildFromFile(rebuildFile, sha1.Size); err != nil {
+		t.Fatal(err)
+	}
+
+	loadFile, err := os.Open(keysFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loadFile.Close()
+	tbl, err = LoadFromKeysFile(loadFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		n, ok := tbl.Lookup(key)
+		if !ok {
+			t.Errorf("Lookup(%x): got !ok; want ok", key)
+			continue
+		}
+		if int(n) != i {
+			t.Errorf("Lookup(%x): got n=%d; want %d", key, n, i)
+		}
+	}
+}
+
+func TestLoadFromFile_relocate(t *testing.T) {
+	keys := make([][]byte, 100)
+	for i := range keys {
+		sum := sha1.Sum([]byte("key" + strconv.Itoa(i)))
+		keys[i] = sum[:]
+	}
+	keysFilePath := writeKeysFile(t, keys)
+	keysFile, err := os.Open(keysFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keysFile.Close()
+	tbl, err := BuildFromFile(keysFile, sha1.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcDir := filepath.Dir(keysFilePath)
+	if err = tbl.DumpToFile(filepath.Join(srcDir, "table.mph")); err != nil {
+		t.Fatal(err)
+	}
+
+	dstDir := filepath.Join(t.TempDir(), "moved")
+	if err = os.Rename(srcDir, dstDir); err != nil {
+		t.Fatal(err)
+	}
+	tbl, err = LoadFromFile(filepath.Join(dstDir, "table.mph"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if _, ok := tbl.Lookup(key); !ok {
+			t.Errorf("Lookup(%x): got !ok; want ok", key)
+		}
+	}
+}
+
+func TestTableClose(t *testing.T) {
+	keys := [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")}
+	tbl, err := Build(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tbl.OpenFiles(); got != 0 {
+		t.Errorf("OpenFiles: got %d; want 0", got)
+	}
+	if got := tbl.SizeInBytes(); got < 9 {
+		t.Errorf("SizeInBytes: got %d; want >= 9", got)
+	}
+	if err = tbl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tbl.Lookup(keys[0]); ok {
+		t.Error("Lookup after Close: got ok; want !ok")
+	}
+	if err = tbl.DumpToFile(filepath.Join(t.TempDir(), "table.mph")); err != ErrClosed {
+		t.Errorf("DumpToFile after Close: got %v; want ErrClosed", err)
+	}
+	if err = tbl.Close(); err != ErrClosed {
+		t.Errorf("second Close: got %v; want ErrClosed", err)
+	}
+}
+
+func writeKeysFile(t *testing.T, keys [][]byte) string {
+	t.Helper()
+	keysFilePath := filepath.Join(t.TempDir(), "keys.bin")
+	keysFile, err := os.Create(keysFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if _, err = keysFile.Write(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = keysFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return keysFilePath
+}
+
 func testTable(t *testing.T, keys []string, extra []string) {
 	ks := make([][]byte, len(keys))
 	for i, key := range keys {
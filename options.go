@@ -0,0 +1,208 @@
+package mph
+
+import (
+	"path/filepath"
+	"runtime"
+)
+
+// A LoadOption configures how a dumped Table or ShardedReader is loaded.
+type LoadOption func(*loadOptions)
+
+type loadOptions struct {
+	baseDir     string
+	lazy        bool
+	maxResident int
+	parallelism int
+}
+
+func newLoadOptions(opts []LoadOption) *loadOptions {
+	lo := &loadOptions{parallelism: runtime.GOMAXPROCS(0)}
+	for _, opt := range opts {
+		opt(lo)
+	}
+	return lo
+}
+
+// WithBaseDir resolves the relative paths stored in a dump against dir instead
+// of the directory that contains the dump. This allows loading an index that
+// was built elsewhere and copied to a different location.
+func WithBaseDir(dir string) LoadOption {
+	return func(lo *loadOptions) {
+		lo.baseDir = dir
+	}
+}
+
+// WithLazyLoading defers loading the shards of a ShardedReader until their
+// first lookup, and keeps at most maxResident of them loaded, evicting the
+// least recently used shard to make room for another. A maxResident of zero
+// or less leaves the number of loaded shards unbounded. Loading, eviction and
+// hit counts are reported by ShardedReader.CacheStats.
+func WithLazyLoading(maxResident int) LoadOption {
+	return func(lo *loadOptions) {
+		lo.lazy = true
+		lo.maxResident = maxResident
+	}
+}
+
+// WithLoadParallelism loads at most n shards at a time when a ShardedReader
+// loads all its shards up front. The default is GOMAXPROCS; n < 1 is treated
+// as 1.
+func WithLoadParallelism(n int) LoadOption {
+	return func(lo *loadOptions) {
+		lo.parallelism = max(n, 1)
+	}
+}
+
+// resolveBaseDir returns the directory that relative paths stored in the
+// dump at filePath are resolved against.
+func (lo *loadOptions) resolveBaseDir(filePath string) string {
+	if lo.baseDir != "" {
+		return lo.baseDir
+	}
+	return filepath.Dir(filePath)
+}
+
+// relPath returns target expressed relative to baseDir.
+func relPath(baseDir, target string) (string, error) {
+	absBase, err := filepath.Abs(baseDir)
+	if err != nil {
+		return "", err
+	}
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(absBase, absTarget)
+}
+
+// resolvePath returns p resolved against baseDir. Absolute paths, as written
+// by older versions of this package, are returned unchanged.
+func resolvePath(baseDir, p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(baseDir, p)
+}
+
+// A ShardOption configures a ShardedBuilder created with NewShardedBuilder.
+type ShardOption func(*shardOptions)
+
+type shardOptions struct {
+	shardFunc    ShardFunc
+	maxOpenFiles int
+	maxShardKeys int
+	journal      bool
+	dedup        DedupMode
+	dedupMemory  int
+	sortedRuns   bool
+	overwrite    bool
+	resume       bool // set by ResumeShardedTable
+}
+
+func newShardOptions(opts []ShardOption) *shardOptions {
+	so := &shardOptions{
+		shardFunc:    ShardByPrefix,
+		maxOpenFiles: DefaultMaxOpenFiles,
+		dedupMemory:  DefaultDedupMemory,
+	}
+	for _, opt := range opts {
+		opt(so)
+	}
+	return so
+}
+
+// WithShardMode selects one of the built-in ShardFuncs. The default is
+// ShardByPrefix.
+func WithShardMode(mode ShardMode) ShardOption {
+	return WithShardFunc(mode)
+}
+
+// WithShardFunc assigns keys to shards with f, which must have been
+// registered with RegisterShardFunc. The builder routes keys with the
+// registered ShardFunc named like f, as loaders of the table do.
+func WithShardFunc(f ShardFunc) ShardOption {
+	return func(so *shardOptions) {
+		so.shardFunc = f
+	}
+}
+
+// WithMaxOpenFiles caps the number of shard keys files that are open at once
+// during ingestion, regardless of the number of shards. When the cap is
+// reached, the least recently written shard file is closed. Files are only
+// opened to write out full shard buffers, so a cap below the number of shards
+// costs one reopen per buffer of keys rather than per key. The cap also
+// bounds the shards that the reader returned by Commit keeps loaded.
+func WithMaxOpenFiles(n int) ShardOption {
+	return func(so *shardOptions) {
+		so.maxOpenFiles = n
+	}
+}
+
+// WithMaxShardKeys sets a budget of n keys per shard. On Commit, every shard
+// holding more keys is split in two on the next key bit after its prefix,
+// recursively, until all shards fit; lookups follow the resulting trie. Keys
+// must be long enough to tell the keys of an oversized shard apart. Since
+// shards are split on key bits, a budget can only be set with ShardByPrefix.
+// The default of 0 disables splitting.
+func WithMaxShardKeys(n int) ShardOption {
+	return func(so *shardOptions) {
+		so.maxShardKeys = n
+	}
+}
+
+// WithJournal makes the build resumable with ResumeShardedTable. The builder
+// keeps a journal of its progress in its shard directory, which must not
+// already hold one: the key counts recorded by ShardedBuilder.Checkpoint and
+// the shards built by Commit. A failed Commit then leaves the shard files in
+// place instead of removing them, and a successful one removes the journal.
+func WithJournal() ShardOption {
+	return func(so *shardOptions) {
+		so.journal = true
+	}
+}
+
+// WithDedup makes Commit eliminate duplicate keys from every shard before
+// building it, as selected by mode.
+func WithDedup(mode DedupMode) ShardOption {
+	return func(so *shardOptions) {
+		so.dedup = mode
+	}
+}
+
+// WithDedupMemory sets the size of the keys of a shard above which duplicate
+// elimination switches from an in-memory hash set to an external sort. It is
+// also the memory the sort uses per shard being built.
+func WithDedupMemory(n int) ShardOption {
+	return func(so *shardOptions) {
+		so.dedupMemory = n
+	}
+}
+
+// WithSortedRuns makes the builder collect keys in two run buffers of half of
+// buffSzBytes instead of one writer per shard. Keys are put in one buffer
+// while the other, full one is sorted by shard and key and spilled to a run
+// file in the shard directory. Commit merges the runs into the shard keys
+// files, at most WithMaxOpenFiles runs at a time. Memory and open files during
+// ingestion then do not depend on the number of shards, and every shard keys
+// file is sorted, so that duplicate keys are eliminated while merging at no
+// extra cost. It cannot be combined with WithJournal.
+func WithSortedRuns() ShardOption {
+	return func(so *shardOptions) {
+		so.sortedRuns = true
+	}
+}
+
+// WithOverwrite lets the builder remove the index files, such as shard keys
+// files and a journal, that its shard directory already holds. Without it,
+// NewShardedBuilder refuses to write over them and returns ErrIndexExists.
+func WithOverwrite() ShardOption {
+	return func(so *shardOptions) {
+		so.overwrite = true
+	}
+}
+
+func withResume() ShardOption {
+	return func(so *shardOptions) {
+		so.resume = true
+	}
+}
@@ -0,0 +1,210 @@
+package mph
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Reloader serves the latest version of a table that is replaced on disk,
+// such as a daily rebuilt index. It watches either the root directory of
+// generations (see PublishGeneration), whose CURRENT file names the version
+// to serve, or a manifest file, which is replaced as a whole. When the
+// version on disk changes, the Reloader loads it in the background and swaps
+// it in. The version it replaces is closed once the lookups in flight on it
+// are done.
+//
+// T is *Table or *ShardedReader for the Reloaders returned by NewTableReloader
+// and NewShardedReloader.
+type Reloader[T io.Closer] struct {
+	path         string
+	generational bool
+	load         func(manifestPath string) (T, error)
+	cur          atomic.Pointer[version[T]] // nil once closed
+	mu           sync.Mutex                 // serializes reloads, guards stamp and closed
+	stamp        string                     // identifies the version being served
+	closed       bool
+	errMu        sync.Mutex
+	err          error // of the last background reload
+	stop         chan struct{}
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// A version is a loaded table along with the number of its holders: the
+// Reloader while it is current, plus the callers of Acquire that have not
+// released it yet. It is closed when the count drops to zero.
+type version[T io.Closer] struct {
+	value T
+	refs  atomic.Int64
+}
+
+func (v *version[T]) release() {
+	if v.refs.Add(-1) == 0 {
+		v.value.Close()
+	}
+}
+
+// NewReloader loads the current version of the table at path with load and
+// returns a Reloader that serves it. path is either a generation root
+// directory, in which case load is passed the manifest of its current
+// generation, or a manifest file. If pollInterval is positive, path is checked
+// for a new version every pollInterval; otherwise only calls to Reload check.
+func NewReloader[T io.Closer](
+	path string,
+	pollInterval time.Duration,
+	load func(manifestPath string) (T, error),
+) (*Reloader[T], error) {
+	stats, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	rl := &Reloader[T]{
+		path:         path,
+		generational: stats.IsDir(),
+		load:         load,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	if err = rl.Reload(); err != nil {
+		return nil, err
+	}
+	if pollInterval <= 0 {
+		close(rl.done)
+		return rl, nil
+	}
+	go rl.watch(pollInterval)
+	return rl, nil
+}
+
+// NewTableReloader returns a Reloader of the Table dumped with DumpToFile at
+// path, or of the current generation under path, loaded with opts.
+func NewTableReloader(path string, pollInterval time.Duration, opts ...LoadOption) (*Reloader[*Table], error) {
+	return NewReloader(path, pollInterval, func(manifestPath string) (*Table, error) {
+		return LoadFromFile(manifestPath, opts...)
+	})
+}
+
+// NewShardedReloader returns a Reloader of the ShardedReader dumped at path,
+// or of the current generation under path, loaded with opts.
+func NewShardedReloader(path string, pollInterval time.Duration, opts ...LoadOption) (*Reloader[*ShardedReader], error) {
+	return NewReloader(path, pollInterval, func(manifestPath string) (*ShardedReader, error) {
+		return LoadShardedTableFromFile(manifestPath, opts...)
+	})
+}
+
+func (rl *Reloader[T]) watch(pollInterval time.Duration) {
+	defer close(rl.done)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rl.stop:
+			return
+		case <-ticker.C:
+			err := rl.Reload()
+			rl.errMu.Lock()
+			rl.err = err
+			rl.errMu.Unlock()
+		}
+	}
+}
+
+// Err returns the error of the last background check for a new version, or
+// nil if it succeeded.
+func (rl *Reloader[T]) Err() error {
+	rl.errMu.Lock()
+	defer rl.errMu.Unlock()
+	return rl.err
+}
+
+// Acquire returns the version being served and a function that must be
+// called once the caller is done with it. The version is not closed before
+// then, even if a newer one is swapped in.
+func (rl *Reloader[T]) Acquire() (T, func(), error) {
+	for {
+		v := rl.cur.Load()
+		if v == nil {
+			var zero T
+			return zero, nil, ErrClosed
+		}
+		// A version whose count dropped to zero has been replaced, and is
+		// being closed: load the pointer again.
+		n := v.refs.Load()
+		if n > 0 && v.refs.CompareAndSwap(n, n+1) {
+			return v.value, v.release, nil
+		}
+	}
+}
+
+// Reload checks path for a new version and, if there is one, loads it and
+// swaps it in. The version being served is left in place if loading fails.
+func (rl *Reloader[T]) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.closed {
+		return ErrClosed
+	}
+	manifestPath, stamp, err := rl.locate()
+	if err != nil {
+		return err
+	}
+	if stamp == rl.stamp {
+		return nil
+	}
+	value, err := rl.load(manifestPath)
+	if err != nil {
+		return err
+	}
+	v := &version[T]{value: value}
+	v.refs.Store(1)
+	if old := rl.cur.Swap(v); old != nil {
+		old.release()
+	}
+	rl.stamp = stamp
+	return nil
+}
+
+// locate returns the manifest of the version on disk and a stamp that changes
+// whenever the version does.
+func (rl *Reloader[T]) locate() (string, string, error) {
+	manifestPath := rl.path
+	if rl.generational {
+		var err error
+		if manifestPath, err = CurrentManifest(rl.path); err != nil {
+			return "", "", err
+		}
+	}
+	stats, err := os.Stat(manifestPath)
+	if err != nil {
+		return "", "", err
+	}
+	stamp := fmt.Sprintf("%d/%d", stats.ModTime().UnixNano(), stats.Size())
+	if rl.generational {
+		// A generation can be republished under the same manifest path.
+		stamp = manifestPath + "/" + stamp
+	}
+	return manifestPath, stamp, nil
+}
+
+// Close stops watching for new versions and releases the version being
+// served, which is closed once all its holders have released it. It returns
+// ErrClosed if rl is already closed.
+func (rl *Reloader[T]) Close() error {
+	err := ErrClosed
+	rl.closeOnce.Do(func() {
+		close(rl.stop)
+		<-rl.done
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		rl.closed = true
+		if v := rl.cur.Swap(nil); v != nil {
+			v.release()
+		}
+		err = nil
+	})
+	return err
+}
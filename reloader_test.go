@@ -0,0 +1,137 @@
+package mph
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShardedReloader(t *testing.T) {
+	rootDir := t.TempDir()
+	keys := sha1Keys(1100)
+	publish := func(keys [][]byte) {
+		t.Helper()
+		genDir, err := NewGeneration(rootDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := buildShardedTable(t, genDir, keys, 2)
+		defer st.Close()
+		if err = PublishGeneration(st, rootDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish(keys[:500])
+
+	rl, err := NewShardedReloader(rootDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, release, err := rl.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := old.NumKeys(); got != 500 {
+		t.Fatalf("NumKeys: got %d; want 500", got)
+	}
+
+	publish(keys[:1000])
+	if err = rl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	cur, releaseCur, err := rl.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cur.NumKeys(); got != 1000 {
+		t.Errorf("NumKeys after Reload: got %d; want 1000", got)
+	}
+	checkShardedLookups(t, cur, keys[:1000])
+	releaseCur()
+
+	// The old version stays usable until it is released.
+	checkShardedLookups(t, old, keys[:500])
+	release()
+	if _, ok := old.Lookup(keys[0]); ok {
+		t.Error("Lookup on the released old version: got ok; want it closed")
+	}
+
+	// An update of the current generation rewrites its manifest in place.
+	manifestPath, err := CurrentManifest(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := NewShardedUpdater(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys[1000:] {
+		if err = u.Put(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	updated, err := u.Commit(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated.Close()
+	if err = rl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	cur, releaseCur, err = rl.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkShardedLookups(t, cur, keys)
+	releaseCur()
+
+	if err = rl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = rl.Acquire(); err != ErrClosed {
+		t.Errorf("Acquire after Close: got %v; want ErrClosed", err)
+	}
+	if err = rl.Close(); err != ErrClosed {
+		t.Errorf("second Close: got %v; want ErrClosed", err)
+	}
+}
+
+func TestTableReloaderPolling(t *testing.T) {
+	keys := sha1Keys(200)
+	dumpPath := filepath.Join(t.TempDir(), "table.mph")
+	dump := func(keys [][]byte) {
+		t.Helper()
+		table, err := Build(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer table.Close()
+		if err = table.DumpToFile(dumpPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dump(keys[:100])
+
+	rl, err := NewTableReloader(dumpPath, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	dump(keys)
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		table, release, err := rl.Acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ok := table.Lookup(keys[150])
+		release()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("new version not loaded; last error: %v", rl.Err())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,208 @@
+package mph
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"unsafe"
+)
+
+// shardPrefixLen is the length of the shard index prefix of run records.
+const shardPrefixLen = 4
+
+// sortedRuns holds the run buffers and the spilled runs of a ShardedBuilder
+// created with WithSortedRuns. Keys are put in one buffer while the other, full
+// one is sorted and spilled outside the lock, at most one spill at a time.
+type sortedRuns struct {
+	dirPath  string
+	recLen   int
+	mu       sync.Mutex // guards the fields below and the counts of the builder
+	cond     *sync.Cond // signaled when a spill finishes
+	buff     []byte
+	spare    []byte // the other buffer, nil while it is being spilled
+	spilling bool
+	err      error // of the last spill, if it failed
+	paths    []string
+	next     int // number of the next run file
+}
+
+func newSortedRuns(dirPath string, keyLen, buffSzBytes int) *sortedRuns {
+	recLen := shardPrefixLen + keyLen
+	buffRecs := max(buffSzBytes/recLen/2, 1)
+	sr := &sortedRuns{
+		dirPath: dirPath,
+		recLen:  recLen,
+		buff:    make([]byte, 0, buffRecs*recLen),
+		spare:   make([]byte, 0, buffRecs*recLen),
+	}
+	sr.cond = sync.NewCond(&sr.mu)
+	return sr
+}
+
+func (sr *sortedRuns) runPath() string {
+	runPath := filepath.Join(sr.dirPath, "sort."+strconv.Itoa(sr.next)+".run")
+	sr.next++
+	return runPath
+}
+
+// put appends key to the run buffer as a record of shard shardIdx and
+// increments count. The caller that fills the buffer spills it, unless a
+// spill is already in flight; it then waits for the buffer to be swapped.
+func (sr *sortedRuns) put(shardIdx uint64, key []byte, count *uint) error {
+	sr.mu.Lock()
+	for len(sr.buff) == cap(sr.buff) && sr.err == nil {
+		sr.cond.Wait()
+	}
+	if sr.err != nil {
+		sr.mu.Unlock()
+		return sr.err
+	}
+	sr.buff = binary.BigEndian.AppendUint32(sr.buff, uint32(shardIdx))
+	sr.buff = append(sr.buff, key...)
+	*count++
+	if len(sr.buff) < cap(sr.buff) || sr.spilling {
+		sr.mu.Unlock()
+		return nil
+	}
+	sr.spilling = true
+	for len(sr.buff) == cap(sr.buff) && sr.err == nil {
+		full := sr.buff
+		sr.buff, sr.spare = sr.spare, nil
+		runPath := sr.runPath()
+		sr.mu.Unlock()
+		err := writeSortedRun(runPath, full, sr.recLen)
+		sr.mu.Lock()
+		if err != nil {
+			sr.err = err
+		} else {
+			sr.paths = append(sr.paths, runPath)
+		}
+		sr.spare = full[:0]
+		sr.cond.Broadcast()
+	}
+	sr.spilling = false
+	err := sr.err
+	sr.mu.Unlock()
+	return err
+}
+
+// spill sorts the run buffer, writes it to a new run file and empties it. It
+// must not be called concurrently with put.
+func (sr *sortedRuns) spill() error {
+	if sr.err != nil {
+		return sr.err
+	}
+	if len(sr.buff) == 0 {
+		return nil
+	}
+	runPath := sr.runPath()
+	if err := writeSortedRun(runPath, sr.buff, sr.recLen); err != nil {
+		return err
+	}
+	sr.paths = append(sr.paths, runPath)
+	sr.buff = sr.buff[:0]
+	return nil
+}
+
+// reduce merges runs, fanIn at a time, until at most fanIn of them are left.
+func (sr *sortedRuns) reduce(fanIn int) error {
+	var err error
+	sr.paths, err = reduceRuns(sr.paths, sr.recLen, fanIn, sr.runPath)
+	return err
+}
+
+// removeAll removes the run files and releases the run buffers.
+func (sr *sortedRuns) removeAll() {
+	for _, runPath := range sr.paths {
+		os.Remove(runPath)
+	}
+	sr.paths = nil
+	sr.buff = nil
+	sr.spare = nil
+}
+
+func (sr *sortedRuns) sizeInBytes() int64 {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	size := int64(unsafe.Sizeof(*sr)) + int64(cap(sr.buff)) + int64(cap(sr.spare))
+	for _, runPath := range sr.paths {
+		size += int64(len(runPath))
+	}
+	return size
+}
+
+// partitionRuns spills the run buffer being filled and merges all runs into
+// the keys files of the shards, registering them with the writers of b. If b
+// eliminates duplicates, they are dropped here, since they are adjacent in
+// the merged runs, and counted in b.duplicates. The run files are removed in
+// any case.
+func (b *ShardedBuilder) partitionRuns() error {
+	sr := b.runs
+	defer sr.removeAll()
+	if err := sr.spill(); err != nil {
+		return err
+	}
+	if err := sr.reduce(max(b.writers.maxOpen-1, 2)); err != nil {
+		return err
+	}
+
+	var (
+		f        *os.File
+		w        *bufio.Writer
+		shardIdx int
+		res      dedupResult
+	)
+	finish := func() error {
+		if f == nil {
+			return nil
+		}
+		err := w.Flush()
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		f = nil
+		if err != nil {
+			return err
+		}
+		if res.count > 0 && b.dedup == DedupStrict {
+			return &DuplicateKeysError{Shard: shardIdx, Count: res.count, Keys: res.keys}
+		}
+		b.duplicates[shardIdx] = res.count
+		res = dedupResult{}
+		return nil
+	}
+	err := mergeRuns(sr.paths, sr.recLen, func(rec, prev []byte) error {
+		if idx := int(binary.BigEndian.Uint32(rec)); f == nil || idx != shardIdx {
+			if err := finish(); err != nil {
+				return err
+			}
+			tf := b.writers.newTabFile(filepath.Join(b.mphDirPath, fmt.Sprintf("%d.bin", idx)))
+			tf.created = true
+			var err error
+			if f, err = os.Create(tf.path); err != nil {
+				return err
+			}
+			w = bufio.NewWriter(f)
+			b.writers.files[idx] = tf
+			shardIdx = idx
+		}
+		if b.dedup != DedupOff && prev != nil && bytes.Equal(rec, prev) {
+			res.add(rec[shardPrefixLen:])
+			return nil
+		}
+		_, err := w.Write(rec[shardPrefixLen:])
+		return err
+	})
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return err
+	}
+	return finish()
+}
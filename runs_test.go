@@ -0,0 +1,163 @@
+package mph
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestShardedBuilderSortedRuns(t *testing.T) {
+	keys := sha1Keys(5000)
+	mphDir := t.TempDir()
+	// Runs of 50 keys, merged 3 at a time.
+	b, err := NewShardedBuilder(
+		sha1.Size,
+		8,
+		100*(shardPrefixLen+sha1.Size),
+		mphDir,
+		WithSortedRuns(),
+		WithMaxOpenFiles(4),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err = b.Put(key); err != nil {
+			t.Fatal(err)
+		}
+		if n := b.OpenFiles(); n != 0 {
+			t.Fatalf("OpenFiles during ingestion: got %d; want 0", n)
+		}
+	}
+	st, err := b.Commit(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if got := st.NumKeys(); got != uint64(len(keys)) {
+		t.Errorf("NumKeys: got %d; want %d", got, len(keys))
+	}
+	checkShardedLookups(t, st, keys)
+
+	for i, tabFilePath := range st.tabFilePaths {
+		data, err := os.ReadFile(tabFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = data[:int(st.counts[i])*sha1.Size]
+		for off := sha1.Size; off < len(data); off += sha1.Size {
+			if bytes.Compare(data[off-sha1.Size:off], data[off:off+sha1.Size]) >= 0 {
+				t.Fatalf("shard %d: keys file is not sorted at key %d", i, off/sha1.Size)
+			}
+		}
+	}
+	runs, err := filepath.Glob(filepath.Join(mphDir, "*.run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 0 {
+		t.Errorf("run files left after Commit: %v", runs)
+	}
+}
+
+func TestShardedBuilderSortedRunsConcurrent(t *testing.T) {
+	const numProducers = 4
+	keys := sha1Keys(20000)
+	b, err := NewShardedBuilder(sha1.Size, 6, 1<<12, t.TempDir(), WithSortedRuns())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, numProducers)
+	for p := 0; p < numProducers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := p; i < len(keys); i += numProducers {
+				if err := b.Put(keys[i]); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	st, err := b.Commit(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if got := st.NumKeys(); got != uint64(len(keys)) {
+		t.Errorf("NumKeys: got %d; want %d", got, len(keys))
+	}
+	checkShardedLookups(t, st, keys)
+}
+
+func TestShardedBuilderSortedRunsDedup(t *testing.T) {
+	keys := sha1Keys(1000)
+	dups := append(append([][]byte(nil), keys...), keys[:200]...)
+	dups = append(dups, keys[:10]...)
+
+	b, err := NewShardedBuilder(sha1.Size, 3, 4096, t.TempDir(), WithSortedRuns(), WithDedup(DedupDrop))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range dups {
+		if err = b.Put(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st, err := b.Commit(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dropped uint
+	for _, n := range b.Duplicates() {
+		dropped += n
+	}
+	if dropped != 210 {
+		t.Errorf("dropped %d duplicates; want 210", dropped)
+	}
+	if got := st.NumKeys(); got != uint64(len(keys)) {
+		t.Errorf("NumKeys: got %d; want %d", got, len(keys))
+	}
+	checkShardedLookups(t, st, keys)
+	st.Close()
+
+	mphDir := t.TempDir()
+	b, err = NewShardedBuilder(sha1.Size, 3, 4096, mphDir, WithSortedRuns(), WithDedup(DedupStrict))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range dups {
+		if err = b.Put(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = b.Commit(context.Background(), 0)
+	var dupErr *DuplicateKeysError
+	if !errors.As(err, &dupErr) {
+		t.Fatalf("Commit: got %v; want a DuplicateKeysError", err)
+	}
+	entries := shardDirEntries(t, mphDir)
+	if len(entries) != 0 {
+		t.Errorf("shard dir after failed Commit: got %d entries; want none", len(entries))
+	}
+}
+
+func TestShardedBuilderSortedRunsJournal(t *testing.T) {
+	_, err := NewShardedBuilder(sha1.Size, 3, 4096, t.TempDir(), WithSortedRuns(), WithJournal())
+	if err == nil || !strings.Contains(err.Error(), "journal") {
+		t.Errorf("NewShardedBuilder: got %v; want an error about the journal", err)
+	}
+}
@@ -0,0 +1,168 @@
+package mph
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"unsafe"
+)
+
+// A shardCache holds the shards of a lazily loaded ShardedReader. Shards are
+// loaded on first use, and once more than maxResident are loaded the least
+// recently used one is evicted. A shard that is evicted while a lookup is
+// using it is closed once the lookup releases it. Shards are loaded without
+// holding the cache lock, and concurrent lookups of a shard that is being
+// loaded wait for that load instead of starting their own.
+type shardCache struct {
+	load        func(shardIdx uint64) (*Table, error)
+	maxResident int
+	mu          sync.Mutex // guards all fields below
+	shards      []*cachedShard
+	loading     map[uint64]*shardLoad // loads in flight
+	lru         *list.List            // resident shards, most recently used first
+	stats       ShardCacheStats
+	closed      bool
+}
+
+type cachedShard struct {
+	idx     uint64
+	table   *Table
+	refs    int           // lookups using table
+	elem    *list.Element // position in shardCache.lru, nil once evicted
+	evicted bool
+}
+
+// A shardLoad is a load of a shard in flight. done is closed once cs or err is
+// set.
+type shardLoad struct {
+	done    chan struct{}
+	waiters int // lookups waiting for the load, besides the one loading
+	cs      *cachedShard
+	err     error
+}
+
+func newShardCache(numShards, maxResident int, load func(uint64) (*Table, error)) *shardCache {
+	return &shardCache{
+		load:        load,
+		maxResident: maxResident,
+		shards:      make([]*cachedShard, numShards),
+		loading:     make(map[uint64]*shardLoad),
+		lru:         list.New(),
+		stats:       ShardCacheStats{MaxResident: maxResident},
+	}
+}
+
+// acquire returns shard shardIdx, loading it if it is not resident. The
+// caller must hand it back to release once done with it.
+func (c *shardCache) acquire(shardIdx uint64) (*cachedShard, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if cs := c.shards[shardIdx]; cs != nil {
+		c.stats.Hits++
+		c.lru.MoveToFront(cs.elem)
+		cs.refs++
+		c.mu.Unlock()
+		return cs, nil
+	}
+	if ld := c.loading[shardIdx]; ld != nil {
+		c.stats.Hits++
+		ld.waiters++
+		c.mu.Unlock()
+		<-ld.done
+		return ld.cs, ld.err
+	}
+	ld := &shardLoad{done: make(chan struct{})}
+	c.loading[shardIdx] = ld
+	c.mu.Unlock()
+
+	table, err := c.load(shardIdx)
+
+	c.mu.Lock()
+	delete(c.loading, shardIdx)
+	switch {
+	case err != nil:
+		c.stats.LoadErrors++
+		ld.err = err
+	case c.closed:
+		table.Close()
+		ld.err = ErrClosed
+	default:
+		c.stats.Loads++
+		// The waiters hold references too, so the shard cannot be closed
+		// before they get it.
+		ld.cs = &cachedShard{idx: shardIdx, table: table, refs: 1 + ld.waiters}
+		ld.cs.elem = c.lru.PushFront(ld.cs)
+		c.shards[shardIdx] = ld.cs
+		for c.maxResident > 0 && c.lru.Len() > c.maxResident {
+			c.evict(c.lru.Back().Value.(*cachedShard))
+		}
+	}
+	c.mu.Unlock()
+	close(ld.done)
+	return ld.cs, ld.err
+}
+
+// evict drops cs from the cache and closes it unless it is in use.
+func (c *shardCache) evict(cs *cachedShard) {
+	c.lru.Remove(cs.elem)
+	cs.elem = nil
+	cs.evicted = true
+	c.shards[cs.idx] = nil
+	c.stats.Evictions++
+	if cs.refs == 0 {
+		cs.table.Close()
+	}
+}
+
+func (c *shardCache) release(cs *cachedShard) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cs.refs--
+	if cs.refs == 0 && cs.evicted {
+		cs.table.Close()
+	}
+}
+
+// close closes all resident shards. Shards whose load is in flight are closed
+// once loaded.
+func (c *shardCache) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	var errs []error
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		errs = append(errs, e.Value.(*cachedShard).table.Close())
+	}
+	c.lru.Init()
+	clear(c.shards)
+	return errors.Join(errs...)
+}
+
+// resident calls f for every resident shard.
+func (c *shardCache) resident(f func(shardIdx uint64, table *Table)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		cs := e.Value.(*cachedShard)
+		f(cs.idx, cs.table)
+	}
+}
+
+func (c *shardCache) cacheStats() ShardCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Resident = c.lru.Len()
+	return s
+}
+
+func (c *shardCache) sizeInBytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	size := int64(unsafe.Sizeof(*c))
+	size += int64(unsafe.Sizeof((*cachedShard)(nil))) * int64(cap(c.shards))
+	return size + int64(unsafe.Sizeof(cachedShard{}))*int64(c.lru.Len())
+}
@@ -0,0 +1,128 @@
+package mph
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A ShardFunc assigns the keys of a sharded table to shards. A ShardFunc is
+// recorded in the manifest by name, and a loaded table resolves the name with
+// the registry populated by RegisterShardFunc. Every process that builds or
+// loads a table must therefore register the same deterministic ShardFunc
+// under the same name.
+type ShardFunc interface {
+	// Name identifies the ShardFunc in manifests.
+	Name() string
+
+	// ShardIndex returns the shard of key among 2^bits shards.
+	ShardIndex(key []byte, bits int) (uint64, error)
+}
+
+var (
+	shardFuncsMu sync.RWMutex
+	shardFuncs   = make(map[string]ShardFunc)
+)
+
+func init() {
+	RegisterShardFunc(ShardByPrefix)
+	RegisterShardFunc(ShardByHash)
+}
+
+// RegisterShardFunc makes f available by name to NewShardedBuilder and to the
+// functions that load sharded tables. It panics if f is nil or if a ShardFunc
+// with the same name is already registered.
+func RegisterShardFunc(f ShardFunc) {
+	if f == nil {
+		panic("mph: RegisterShardFunc of nil ShardFunc")
+	}
+	shardFuncsMu.Lock()
+	defer shardFuncsMu.Unlock()
+	if _, dup := shardFuncs[f.Name()]; dup {
+		panic("mph: RegisterShardFunc called twice for " + f.Name())
+	}
+	shardFuncs[f.Name()] = f
+}
+
+func lookupShardFunc(name string) (ShardFunc, error) {
+	shardFuncsMu.RLock()
+	defer shardFuncsMu.RUnlock()
+	f, ok := shardFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("shard func %q is not registered", name)
+	}
+	return f, nil
+}
+
+// A ShardMode is one of the built-in ShardFuncs.
+type ShardMode int
+
+const (
+	// ShardByPrefix assigns keys to shards by their leading prefBits bits.
+	// This balances the shards only if the keys are uniformly distributed.
+	ShardByPrefix ShardMode = iota
+
+	// ShardByHash assigns keys to shards by a hash of the whole key, which
+	// balances the shards even if keys share long common prefixes.
+	ShardByHash
+)
+
+// shardHashSeed differs from the seeds used within a shard, so that the hash
+// that picks the shard is independent of the ones that place keys in it.
+const shardHashSeed murmurSeed = 0x5bd1e995
+
+// Name implements ShardFunc.
+func (mode ShardMode) Name() string {
+	switch mode {
+	case ShardByPrefix:
+		return "prefix"
+	case ShardByHash:
+		return "hash"
+	}
+	return fmt.Sprintf("ShardMode(%d)", int(mode))
+}
+
+// ShardIndex implements ShardFunc.
+func (mode ShardMode) ShardIndex(key []byte, bits int) (uint64, error) {
+	switch mode {
+	case ShardByPrefix:
+		return shardIndex(key, bits)
+	case ShardByHash:
+		return uint64(shardHashSeed.hash(key) >> (32 - bits)), nil
+	}
+	return 0, fmt.Errorf("unknown shard mode %d", int(mode))
+}
+
+// parentShard returns the shard among 2^bits that holds the keys of shard
+// shardIdx among 2^oldBits, where bits <= oldBits.
+func (mode ShardMode) parentShard(shardIdx uint64, oldBits, bits int) uint64 {
+	if mode == ShardByHash {
+		return shardIdx >> (oldBits - bits)
+	}
+	// Rebuild the prefix of the keys of the shard and shorten it.
+	numBytes, rem := oldBits>>3, oldBits&7
+	prefix := make([]byte, numBytes+1)
+	for i := 0; i < numBytes; i++ {
+		prefix[i] = byte(shardIdx >> (8 * i))
+	}
+	if rem > 0 {
+		prefix[numBytes] = byte(shardIdx>>(8*numBytes)) << (8 - rem)
+	}
+	parent, _ := shardIndex(prefix, bits)
+	return parent
+}
+
+func shardIndex(key []byte, prefBits int) (uint64, error) {
+	numBytes, rem := prefBits>>3, prefBits&7
+	if len(key) < numBytes || (rem > 0 && len(key) <= numBytes) {
+		return 0, fmt.Errorf("key too short for %d-bit prefix", prefBits)
+	}
+	var shardIdx uint64
+	for i := 0; i < numBytes; i++ {
+		shardIdx |= uint64(key[i]) << (8 * i)
+	}
+	if rem > 0 {
+		remainingBits := key[numBytes] >> (8 - rem)
+		shardIdx |= uint64(remainingBits) << (8 * numBytes)
+	}
+	return shardIdx, nil
+}
@@ -0,0 +1,119 @@
+package mph
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+)
+
+// tenantShardFunc shards keys on the tenant ID stored in bytes 4 to 8.
+type tenantShardFunc struct{}
+
+func (tenantShardFunc) Name() string { return "test-tenant" }
+
+func (tenantShardFunc) ShardIndex(key []byte, bits int) (uint64, error) {
+	tenant := binary.BigEndian.Uint32(key[4:8])
+	return uint64(tenant) & (1<<bits - 1), nil
+}
+
+type unregisteredShardFunc struct{ tenantShardFunc }
+
+func (unregisteredShardFunc) Name() string { return "test-unregistered" }
+
+// impostorShardFunc has the name of tenantShardFunc but shards keys
+// differently.
+type impostorShardFunc struct{ tenantShardFunc }
+
+func (impostorShardFunc) ShardIndex(key []byte, bits int) (uint64, error) {
+	return 0, nil
+}
+
+func init() {
+	RegisterShardFunc(tenantShardFunc{})
+}
+
+func TestCustomShardFunc(t *testing.T) {
+	const prefBits = 3
+	var keys [][]byte
+	for tenant := uint32(0); tenant < 5; tenant++ {
+		for i := uint32(0); i < 100; i++ {
+			key := binary.BigEndian.AppendUint32(nil, i)
+			key = binary.BigEndian.AppendUint32(key, tenant)
+			keys = append(keys, key)
+		}
+	}
+
+	dir := t.TempDir()
+	st := buildShardedTable(t, filepath.Join(dir, "shards"), keys, prefBits, WithShardFunc(tenantShardFunc{}))
+	for shard, cnt := range st.GetCounts() {
+		want := uint(0)
+		if shard < 5 {
+			want = 100
+		}
+		if cnt != want {
+			t.Errorf("shard %d: got %d keys; want %d", shard, cnt, want)
+		}
+	}
+
+	manifestPath := filepath.Join(dir, "sharded.mph")
+	if err := st.DumpToFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	st, err := LoadShardedTableFromFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.shardFunc.Name() != "test-tenant" {
+		t.Errorf("loaded shard func: got %q; want %q", st.shardFunc.Name(), "test-tenant")
+	}
+	checkShardedLookups(t, st, keys)
+}
+
+func TestUnregisteredShardFunc(t *testing.T) {
+	_, err := NewShardedBuilder(8, 3, 1024, t.TempDir(), WithShardFunc(unregisteredShardFunc{}))
+	if err == nil {
+		t.Error("NewShardedBuilder with unregistered shard func: got nil error; want error")
+	}
+}
+
+func TestShardFuncInstance(t *testing.T) {
+	key := binary.BigEndian.AppendUint64(nil, 3)
+	b, err := NewShardedBuilder(8, 3, 1024, t.TempDir(), WithShardFunc(impostorShardFunc{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err = b.Put(key); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.GetCounts()[3]; got != 1 {
+		t.Errorf("key not routed by the registered shard func: shard 3 holds %d keys", got)
+	}
+}
+
+func TestRegisterShardFuncDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("RegisterShardFunc of duplicate name: got no panic; want panic")
+		}
+	}()
+	RegisterShardFunc(ShardByHash)
+}
+
+func TestParentShard(t *testing.T) {
+	keys := sha1Keys(500)
+	for _, mode := range []ShardMode{ShardByPrefix, ShardByHash} {
+		for _, oldBits := range []int{3, 8, 10, 17} {
+			for bits := 1; bits <= oldBits; bits++ {
+				for _, key := range keys {
+					shardIdx, _ := mode.ShardIndex(key, oldBits)
+					want, _ := mode.ShardIndex(key, bits)
+					if got := mode.parentShard(shardIdx, oldBits, bits); got != want {
+						t.Fatalf("%s: parent of shard %d of %d bits at %d bits: got %d; want %d",
+							mode.Name(), shardIdx, oldBits, bits, got, want)
+					}
+				}
+			}
+		}
+	}
+}
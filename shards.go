@@ -1,251 +1,476 @@
 package mph
 
 import (
-	"bufio"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"path"
-	"sync"
+	"path/filepath"
+	"sort"
+	"unsafe"
 
 	"golang.org/x/sync/errgroup"
 )
 
-type tabFile struct {
-	*os.File
-	buff *bufio.Writer
+// A shardRouter assigns keys to the shards of a sharded table.
+type shardRouter struct {
+	keyLen    int
+	prefBits  int
+	shardFunc ShardFunc
+	roots     []int32    // trie of split shards, nil if none; see resolveShard
+	nodes     [][2]int32 // children of every split node, in preorder
 }
 
-func newTabFile(tFile *os.File, buffSzBytes int) *tabFile {
-	return &tabFile{
-		File: tFile,
-		buff: bufio.NewWriterSize(tFile, buffSzBytes),
+// shardIndex returns the shard that key belongs to.
+func (sr *shardRouter) shardIndex(key []byte) (uint64, error) {
+	shardIdx, err := sr.topShardIndex(key)
+	if err != nil {
+		return 0, err
 	}
+	return sr.resolveShard(key, shardIdx)
 }
 
-func (tf *tabFile) Write(p []byte) (n int, err error) {
-	return tf.buff.Write(p)
+// topShardIndex returns the top-level shard that key belongs to, as assigned
+// by the ShardFunc.
+func (sr *shardRouter) topShardIndex(key []byte) (uint64, error) {
+	shardIdx, err := sr.shardFunc.ShardIndex(key, sr.prefBits)
+	if err != nil {
+		return 0, err
+	}
+	if shardIdx >= 1<<sr.prefBits {
+		return 0, fmt.Errorf(
+			"shard func %q returned shard %d of %d",
+			sr.shardFunc.Name(),
+			shardIdx,
+			1<<sr.prefBits,
+		)
+	}
+	return shardIdx, nil
 }
 
-func (tf *tabFile) Close() error {
-	if err := tf.buff.Flush(); err != nil {
-		return err
-	}
-	return tf.File.Close()
-}
-
-type ShardedTable struct {
-	counts       []uint
-	prefBits     int
-	keyLen       int
-	buffSzBytes  int
-	mphDirPath   string
-	tables       []*Table
-	tabFiles     []*tabFile
-	tabFilePaths []string
-}
-
-func NewShardedTable(
-	keyLen, prefBits, buffSzBytes int,
-	mphDirPath string,
-) (*ShardedTable, error) {
-	if prefBits < 1 {
-		return nil, fmt.Errorf("prefixBits must be >= 1")
-	}
-	if prefBits > 32 {
-		return nil, fmt.Errorf("prefixBits must be <= 32 (memory constraints)")
-	}
-	numTabs := 1 << prefBits
-	tabFiles := make([]*tabFile, numTabs)
-	counts := make([]uint, numTabs)
-	return &ShardedTable{
-		keyLen:      keyLen,
-		buffSzBytes: buffSzBytes / numTabs,
-		prefBits:    prefBits,
-		mphDirPath:  mphDirPath,
-		tabFiles:    tabFiles,
-		counts:      counts,
-	}, nil
+// A ShardedReader is an immutable sharded table, as returned by
+// ShardedBuilder.Commit or loaded with LoadShardedTableFromFile.
+type ShardedReader struct {
+	shardRouter
+	counts        []uint
+	offsets       []uint64 // prefix sums of counts
+	mphDirPath    string
+	tables        []*Table
+	tabFilePaths  []string
+	bundleFile    *os.File // set if the shards are read from a bundle
+	bundleRegions []bundleRegion
+	cache         *shardCache // set if the shards are loaded lazily
+	checksums     []uint32    // of the shard keys files; nil until dumped
+	closed        bool
 }
 
-func (st *ShardedTable) Put(key []byte) error {
-	if len(key) != st.keyLen {
-		return fmt.Errorf("invalid key length %d, expected %d", len(key), st.keyLen)
+// Lookup searches for s in a committed table and returns its index and
+// whether it was found. Indexes are unique across shards and dense in
+// [0, NumKeys()): the keys of shard i occupy the range following the keys of
+// shards 0 to i-1.
+func (r *ShardedReader) Lookup(s []byte) (n uint64, ok bool) {
+	if r.closed || len(s) != r.keyLen {
+		return 0, false
 	}
-	shardIdx, err := shardIndex(key, st.prefBits)
-	if err != nil {
-		return err
+	shardIdx, err := r.shardIndex(s)
+	if err != nil || r.counts[shardIdx] == 0 {
+		return 0, false
 	}
-	if st.tabFiles[shardIdx] == nil {
-		tabFilePath := path.Join(st.mphDirPath, fmt.Sprintf("%d.bin", shardIdx))
-		tblFile, err := os.OpenFile(
-			tabFilePath,
-			os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
-			0644,
-		)
+	var local uint32
+	if r.cache != nil {
+		cs, err := r.cache.acquire(shardIdx)
 		if err != nil {
-			return fmt.Errorf("failed to open table file %s: %v", tabFilePath, err)
+			return 0, false
 		}
-		st.tabFiles[shardIdx] = newTabFile(tblFile, st.buffSzBytes)
+		local, ok = cs.table.Lookup(s)
+		r.cache.release(cs)
+	} else {
+		local, ok = r.tables[shardIdx].Lookup(s)
 	}
-	if _, err = st.tabFiles[shardIdx].Write(key); err != nil {
-		return err
+	if !ok {
+		return 0, false
 	}
-	st.counts[shardIdx]++
-	return nil
+	return r.offsets[shardIdx] + uint64(local), true
 }
 
-func (st *ShardedTable) Commit(grp *errgroup.Group) error {
-	mu := &sync.Mutex{}
-	st.tables = make([]*Table, len(st.tabFiles))
-	st.tabFilePaths = make([]string, len(st.tabFiles))
-	for i, tblFile := range st.tabFiles {
-		if tblFile == nil {
-			continue
-		}
-		st.tabFilePaths[i] = tblFile.Name()
-		idx := i
-		keyFile := tblFile
-		commitFn := func() error {
-			err := keyFile.Close()
-			if err != nil {
-				return err
-			}
-			tFile, err := os.Open(keyFile.Name())
-			if err != nil {
-				return err
-			}
-			table, err := BuildFromFile(tFile, st.keyLen)
-			if err != nil {
-				return err
-			}
-			mu.Lock()
-			st.tables[idx] = table
-			mu.Unlock()
-			return nil
+// Locate maps an index returned by Lookup to the shard holding the key and
+// the key's index within that shard. ok is false if n is out of range.
+func (r *ShardedReader) Locate(n uint64) (shard int, local uint32, ok bool) {
+	if n >= r.NumKeys() {
+		return 0, 0, false
+	}
+	shard = sort.Search(len(r.counts), func(i int) bool {
+		return r.offsets[i+1] > n
+	})
+	return shard, uint32(n - r.offsets[shard]), true
+}
+
+// NumKeys returns the number of keys in r.
+func (r *ShardedReader) NumKeys() uint64 {
+	if r.offsets == nil {
+		return 0
+	}
+	return r.offsets[len(r.offsets)-1]
+}
+
+// prefixSums returns the global index of the first key of every shard,
+// followed by the total number of keys.
+func prefixSums(counts []uint) []uint64 {
+	offsets := make([]uint64, len(counts)+1)
+	for i, cnt := range counts {
+		offsets[i+1] = offsets[i] + uint64(cnt)
+	}
+	return offsets
+}
+
+// GetCounts returns the number of keys in every shard.
+func (r *ShardedReader) GetCounts() []uint {
+	return r.counts
+}
+
+// loadedShards calls f for every shard of r that is loaded.
+func (r *ShardedReader) loadedShards(f func(shardIdx uint64, table *Table)) {
+	if r.cache != nil {
+		r.cache.resident(f)
+		return
+	}
+	for i, table := range r.tables {
+		if table != nil {
+			f(uint64(i), table)
 		}
-		if grp != nil {
-			grp.Go(commitFn)
-		} else {
-			if err := commitFn(); err != nil {
-				return err
-			}
+	}
+}
+
+// Close releases the shards of r. It returns ErrClosed if r is already
+// closed.
+func (r *ShardedReader) Close() error {
+	if r.closed {
+		return ErrClosed
+	}
+	r.closed = true
+	var errs []error
+	for _, table := range r.tables {
+		if table != nil {
+			errs = append(errs, table.Close())
 		}
 	}
-	st.tabFiles = nil
-	return nil
+	if r.cache != nil {
+		errs = append(errs, r.cache.close())
+	}
+	if r.bundleFile != nil {
+		errs = append(errs, r.bundleFile.Close())
+	}
+	r.tables = nil
+	return errors.Join(errs...)
 }
 
-func (st *ShardedTable) Lookup(s []byte) (n uint32, ok bool) {
-	if len(s) != st.keyLen {
-		return 0, false
+// SizeInBytes returns the approximate amount of memory held by r, including
+// its shards.
+func (r *ShardedReader) SizeInBytes() int64 {
+	size := int64(unsafe.Sizeof(*r))
+	size += int64(unsafe.Sizeof(uint(0))) * int64(cap(r.counts))
+	size += 8 * int64(cap(r.offsets))
+	size += int64(unsafe.Sizeof((*Table)(nil))) * int64(cap(r.tables))
+	size += int64(unsafe.Sizeof(bundleRegion{})) * int64(cap(r.bundleRegions))
+	for _, tabFilePath := range r.tabFilePaths {
+		size += int64(unsafe.Sizeof(tabFilePath)) + int64(len(tabFilePath))
 	}
-	if st.tables == nil {
-		return 0, false
+	if r.cache != nil {
+		size += r.cache.sizeInBytes()
 	}
-	shardIdx, err := shardIndex(s, st.prefBits)
-	if err != nil {
-		return 0, false
+	r.loadedShards(func(_ uint64, table *Table) {
+		size += table.SizeInBytes()
+	})
+	return size
+}
+
+// OpenFiles returns the number of file descriptors held open by r.
+func (r *ShardedReader) OpenFiles() int {
+	if r.closed {
+		return 0
 	}
-	if st.tables[shardIdx] == nil {
-		return 0, false
+	n := 0
+	r.loadedShards(func(_ uint64, table *Table) {
+		n += table.OpenFiles()
+	})
+	if r.bundleFile != nil {
+		n++
 	}
-	return st.tables[shardIdx].Lookup(s)
+	return n
 }
 
-func (st *ShardedTable) GetCounts() []uint {
-	return st.counts
+// manifestVersion identifies the layout of shardManifest. Manifests written
+// before it was introduced encode the fields one by one and store absolute
+// paths; see decodeLegacyManifest.
+const manifestVersion = 3
+
+// A shardManifest is the on-disk description of a ShardedReader.
+// MphDirPath is relative to the directory holding the manifest and
+// TabFilePaths are relative to MphDirPath. Version 2 added the trie of split
+// shards, TrieRoots and TrieNodes, and version 3 the CRC-32 (IEEE) of every
+// shard keys file, Checksums, which is 0 for empty shards.
+type shardManifest struct {
+	Version      int
+	Counts       []uint
+	PrefBits     int
+	KeyLen       int
+	ShardFunc    string // empty in manifests that predate ShardFunc
+	MphDirPath   string
+	TabFilePaths []string
+	TrieRoots    []int32
+	TrieNodes    [][2]int32
+	Checksums    []uint32
 }
 
-func (st *ShardedTable) DumpToFile(filePath string) error {
-	dumpFile, err := os.OpenFile(
-		filePath,
-		os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
-		0644,
-	)
-	if err != nil {
-		return err
+// DumpToFile writes the manifest of r to filePath and the footer of every
+// shard to its keys file. Paths are stored relative to the directory of
+// filePath, so the manifest and the shard directory can be moved together.
+func (r *ShardedReader) DumpToFile(filePath string) error {
+	if r.closed {
+		return ErrClosed
 	}
-	encoder := gob.NewEncoder(dumpFile)
-	if err = encoder.Encode(st.counts); err != nil {
-		return err
+	if r.bundleFile != nil {
+		return fmt.Errorf("table is loaded from a bundle; use DumpToBundle")
 	}
-	if err = encoder.Encode(st.prefBits); err != nil {
+	if err := r.dumpShards(); err != nil {
 		return err
 	}
-	if err = encoder.Encode(st.keyLen); err != nil {
+	if err := r.fillChecksums(); err != nil {
 		return err
 	}
-	if err = encoder.Encode(st.mphDirPath); err != nil {
+	m, err := r.manifest(filepath.Dir(filePath))
+	if err != nil {
 		return err
 	}
-	if err = encoder.Encode(st.tabFilePaths); err != nil {
-		return err
+	return writeManifest(filePath, m)
+}
+
+// dumpShards writes the footer of every loaded shard to its keys file. Shards
+// that are not loaded were loaded from a dump, so their footers are in place.
+func (r *ShardedReader) dumpShards() error {
+	var errs []error
+	r.loadedShards(func(_ uint64, table *Table) {
+		errs = append(errs, table.DumpToKeysFile())
+	})
+	return errors.Join(errs...)
+}
+
+// writeManifest atomically replaces the manifest at filePath with m.
+func writeManifest(filePath string, m *shardManifest) error {
+	return writeFileAtomic(filePath, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(m)
+	})
+}
+
+func (r *ShardedReader) manifest(baseDir string) (*shardManifest, error) {
+	mphDirPath, err := relPath(baseDir, r.mphDirPath)
+	if err != nil {
+		return nil, err
 	}
-	for _, table := range st.tables {
-		if table == nil {
+	tabFilePaths := make([]string, len(r.tabFilePaths))
+	for i, tabFilePath := range r.tabFilePaths {
+		if tabFilePath == "" {
 			continue
 		}
-		if err = table.DumpToKeysFile(); err != nil {
-			return err
+		if tabFilePaths[i], err = relPath(r.mphDirPath, tabFilePath); err != nil {
+			return nil, err
 		}
 	}
-	return dumpFile.Close()
+	m := r.baseManifest()
+	m.MphDirPath = mphDirPath
+	m.TabFilePaths = tabFilePaths
+	return m, nil
 }
 
-func LoadShardedTableFromFile(filePath string) (*ShardedTable, error) {
-	dumpFile, err := os.Open(filePath)
+// baseManifest returns the manifest of r without any paths.
+func (r *ShardedReader) baseManifest() *shardManifest {
+	return &shardManifest{
+		Version:   manifestVersion,
+		Counts:    r.counts,
+		PrefBits:  r.prefBits,
+		KeyLen:    r.keyLen,
+		ShardFunc: r.shardFunc.Name(),
+		TrieRoots: r.roots,
+		TrieNodes: r.nodes,
+		Checksums: r.checksums,
+	}
+}
+
+// newShardedReaderFromManifest returns a reader holding the path-independent
+// state described by m, with no shards loaded.
+func newShardedReaderFromManifest(m *shardManifest) (*ShardedReader, error) {
+	shardFuncName := m.ShardFunc
+	if shardFuncName == "" {
+		shardFuncName = ShardByPrefix.Name()
+	}
+	shardFunc, err := lookupShardFunc(shardFuncName)
 	if err != nil {
 		return nil, err
 	}
-	defer dumpFile.Close()
-
-	gobDecoder := gob.NewDecoder(dumpFile)
-	var st ShardedTable
-	if err = gobDecoder.Decode(&st.counts); err != nil {
+	if m.PrefBits < 1 || m.PrefBits > 32 {
+		return nil, fmt.Errorf("manifest has %d prefix bits", m.PrefBits)
+	}
+	if err = checkTrie(m.TrieRoots, m.TrieNodes, m.PrefBits, len(m.Counts)); err != nil {
 		return nil, err
 	}
-	if err = gobDecoder.Decode(&st.prefBits); err != nil {
+	if m.Checksums != nil && len(m.Checksums) != len(m.Counts) {
+		return nil, fmt.Errorf("manifest has %d checksums for %d shards", len(m.Checksums), len(m.Counts))
+	}
+	return &ShardedReader{
+		shardRouter: shardRouter{
+			keyLen:    m.KeyLen,
+			prefBits:  m.PrefBits,
+			shardFunc: shardFunc,
+			roots:     m.TrieRoots,
+			nodes:     m.TrieNodes,
+		},
+		counts:    m.Counts,
+		offsets:   prefixSums(m.Counts),
+		tables:    make([]*Table, len(m.Counts)),
+		checksums: m.Checksums,
+	}, nil
+}
+
+// LoadShardedTableFromFile loads a sharded table from a manifest written by
+// DumpToFile or from a bundle written by DumpToBundle or PackBundle. Relative
+// paths in a manifest are resolved against the directory of filePath unless
+// overridden with WithBaseDir. All shards are loaded up front unless
+// WithLazyLoading is given.
+func LoadShardedTableFromFile(filePath string, opts ...LoadOption) (*ShardedReader, error) {
+	lo := newLoadOptions(opts)
+	bundled, err := isBundle(filePath)
+	if err != nil {
 		return nil, err
 	}
-	if err = gobDecoder.Decode(&st.keyLen); err != nil {
+	if bundled {
+		return loadBundle(filePath, lo)
+	}
+	m, mphDirPath, tabFilePaths, err := openIndex(filePath, opts)
+	if err != nil {
 		return nil, err
 	}
-	if err = gobDecoder.Decode(&st.mphDirPath); err != nil {
+
+	r, err := newShardedReaderFromManifest(m)
+	if err != nil {
 		return nil, err
 	}
-	if err = gobDecoder.Decode(&st.tabFilePaths); err != nil {
+	r.mphDirPath = mphDirPath
+	r.tabFilePaths = tabFilePaths
+	if err = r.loadShards(lo); err != nil {
+		r.Close()
 		return nil, err
 	}
-	st.tables = make([]*Table, len(st.counts))
-	for i, cnt := range st.counts {
+	return r, nil
+}
+
+// loadShards loads the non-empty shards of r, lo.parallelism at a time, or
+// sets r up to load them on first use if lo asks for lazy loading. It returns
+// the errors of all shards that failed to load.
+func (r *ShardedReader) loadShards(lo *loadOptions) error {
+	if lo.lazy {
+		r.cache = newShardCache(len(r.counts), lo.maxResident, r.loadShard)
+		return nil
+	}
+	errs := make([]error, len(r.counts))
+	var grp errgroup.Group
+	grp.SetLimit(lo.parallelism)
+	for i, cnt := range r.counts {
 		if cnt == 0 {
 			continue
 		}
-		tblFile, err := os.Open(st.tabFilePaths[i])
+		grp.Go(func() error {
+			r.tables[i], errs[i] = r.loadShard(uint64(i))
+			return nil
+		})
+	}
+	grp.Wait()
+	return errors.Join(errs...)
+}
+
+// loadShard loads shard shardIdx from its keys file or bundle region.
+func (r *ShardedReader) loadShard(shardIdx uint64) (*Table, error) {
+	if r.bundleFile != nil {
+		region := r.bundleRegions[shardIdx]
+		table, err := loadFromKeysRegion(r.bundleFile, region.Off, region.Len)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("shard %d (%s): %v", shardIdx, r.bundleFile.Name(), err)
 		}
-		st.tables[i], err = LoadFromKeysFile(tblFile)
-		if err != nil {
-			return nil, err
+		return table, nil
+	}
+	tabFilePath := r.tabFilePaths[shardIdx]
+	tblFile, err := os.Open(tabFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("shard %d (%s): %v", shardIdx, tabFilePath, err)
+	}
+	table, err := LoadFromKeysFile(tblFile)
+	if err != nil {
+		tblFile.Close()
+		return nil, fmt.Errorf("shard %d (%s): %v", shardIdx, tabFilePath, err)
+	}
+	return table, nil
+}
+
+func (m *shardManifest) resolveTabFilePaths(mphDirPath string) []string {
+	tabFilePaths := make([]string, len(m.TabFilePaths))
+	for i, tabFilePath := range m.TabFilePaths {
+		tabFilePaths[i] = resolvePath(mphDirPath, tabFilePath)
+	}
+	return tabFilePaths
+}
+
+func readManifest(filePath string) (*shardManifest, error) {
+	dumpFile, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer dumpFile.Close()
+
+	var m shardManifest
+	if err = gob.NewDecoder(dumpFile).Decode(&m); err == nil {
+		if m.Version > manifestVersion {
+			return nil, fmt.Errorf("unsupported manifest version %d", m.Version)
 		}
+		return checkManifestPaths(&m)
+	}
+	if _, seekErr := dumpFile.Seek(0, io.SeekStart); seekErr != nil {
+		return nil, seekErr
 	}
-	return &st, nil
+	legacy, legacyErr := decodeLegacyManifest(gob.NewDecoder(dumpFile))
+	if legacyErr != nil {
+		return nil, err
+	}
+	return checkManifestPaths(legacy)
 }
 
-func shardIndex(key []byte, prefBits int) (uint64, error) {
-	numBytes, rem := prefBits>>3, prefBits&7
-	if len(key) < numBytes || (rem > 0 && len(key) <= numBytes) {
-		return 0, fmt.Errorf("key too short for %d-bit prefix", prefBits)
+// checkManifestPaths returns m if it has a keys file path for every shard.
+func checkManifestPaths(m *shardManifest) (*shardManifest, error) {
+	if len(m.TabFilePaths) != len(m.Counts) {
+		return nil, fmt.Errorf(
+			"manifest has %d shard paths for %d shards",
+			len(m.TabFilePaths),
+			len(m.Counts),
+		)
+	}
+	return m, nil
+}
+
+func decodeLegacyManifest(gobDecoder *gob.Decoder) (*shardManifest, error) {
+	var m shardManifest
+	if err := gobDecoder.Decode(&m.Counts); err != nil {
+		return nil, err
 	}
-	var shardIdx uint64
-	for i := 0; i < numBytes; i++ {
-		shardIdx |= uint64(key[i]) << (8 * i)
+	if err := gobDecoder.Decode(&m.PrefBits); err != nil {
+		return nil, err
 	}
-	if rem > 0 {
-		remainingBits := key[numBytes] >> (8 - rem)
-		shardIdx |= uint64(remainingBits) << (8 * numBytes)
+	if err := gobDecoder.Decode(&m.KeyLen); err != nil {
+		return nil, err
 	}
-	return shardIdx, nil
+	if err := gobDecoder.Decode(&m.MphDirPath); err != nil {
+		return nil, err
+	}
+	if err := gobDecoder.Decode(&m.TabFilePaths); err != nil {
+		return nil, err
+	}
+	return &m, nil
 }
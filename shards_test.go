@@ -1,11 +1,14 @@
 package mph
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/binary"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -30,19 +33,19 @@ func TestBuildSharded(t *testing.T) {
 	defer os.RemoveAll(mphDir)
 
 	keyLen := len(keys[0])
-	st, err := NewShardedTable(keyLen, prefBits, 1024, mphDir)
+	sb, err := NewShardedBuilder(keyLen, prefBits, 1024, mphDir)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	for _, key := range keys {
-		err = st.Put(key)
+		err = sb.Put(key)
 		if err != nil {
 			t.Fatal(err)
 		}
 	}
 
-	err = st.Commit(nil)
+	st, err := sb.Commit(context.Background(), 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -83,7 +86,7 @@ func TestBuildShardedOnLargeDataset(t *testing.T) {
 	}
 	defer os.RemoveAll(mphDir)
 
-	st, err := NewShardedTable(sha1.Size, prefBits, buffSzBts, mphDir)
+	sb, err := NewShardedBuilder(sha1.Size, prefBits, buffSzBts, mphDir, WithOverwrite())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -94,14 +97,14 @@ func TestBuildShardedOnLargeDataset(t *testing.T) {
 	for i := 0; i < numKeys; i++ {
 		hasher.Write([]byte("key" + strconv.Itoa(i)))
 		keys[i] = hasher.Sum(nil)
-		if err = st.Put(keys[i]); err != nil {
+		if err = sb.Put(keys[i]); err != nil {
 			t.Fatal(err)
 		}
 	}
 	t.Logf("Put took %v sec", time.Since(startTime).Seconds())
 
 	startTime = time.Now()
-	err = st.Commit(nil)
+	st, err := sb.Commit(context.Background(), 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -120,7 +123,9 @@ func TestBuildShardedOnLargeDataset(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	st, err = LoadShardedTableFromFile(shardedFilePath)
+	// Every loaded shard holds its keys file open, so the 1<<prefBits shards
+	// are loaded on first use rather than all at once.
+	st, err = LoadShardedTableFromFile(shardedFilePath, WithLazyLoading(DefaultMaxOpenFiles))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -130,3 +135,588 @@ func TestBuildShardedOnLargeDataset(t *testing.T) {
 		}
 	}
 }
+
+func TestShardedTableRelocate(t *testing.T) {
+	keys := sha1Keys(1000)
+	srcDir := filepath.Join(t.TempDir(), "src")
+	st := buildShardedTable(t, filepath.Join(srcDir, "shards"), keys, 4)
+	if err := st.DumpToFile(filepath.Join(srcDir, "sharded.mph")); err != nil {
+		t.Fatal(err)
+	}
+
+	dstDir := filepath.Join(t.TempDir(), "dst")
+	if err := os.Rename(srcDir, dstDir); err != nil {
+		t.Fatal(err)
+	}
+	st, err := LoadShardedTableFromFile(filepath.Join(dstDir, "sharded.mph"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkShardedLookups(t, st, keys)
+
+	// A manifest kept apart from the index resolves against the base dir.
+	manifestPath := filepath.Join(t.TempDir(), "sharded.mph")
+	if err = os.Rename(filepath.Join(dstDir, "sharded.mph"), manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadShardedTableFromFile(manifestPath); err == nil {
+		t.Fatal("LoadShardedTableFromFile without base dir: got nil error; want error")
+	}
+	st, err = LoadShardedTableFromFile(manifestPath, WithBaseDir(dstDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkShardedLookups(t, st, keys)
+}
+
+func TestShardByHash(t *testing.T) {
+	const prefBits = 4
+	keys := make([][]byte, 4000)
+	for i := range keys {
+		keys[i] = binary.BigEndian.AppendUint32([]byte("tenant-0001/"), uint32(i))
+	}
+
+	dir := t.TempDir()
+	st := buildShardedTable(t, filepath.Join(dir, "prefix"), keys, prefBits)
+	if s := st.Stats(); s.NonEmptyShards != 1 {
+		t.Fatalf("ShardByPrefix: got %d non-empty shards; want 1", s.NonEmptyShards)
+	}
+
+	st = buildShardedTable(t, filepath.Join(dir, "hash"), keys, prefBits, WithShardMode(ShardByHash))
+	if s := st.Stats(); s.NonEmptyShards != 1<<prefBits || s.Skew > 1.5 {
+		t.Fatalf("ShardByHash: got %d non-empty shards with skew %v", s.NonEmptyShards, s.Skew)
+	}
+	checkShardedLookups(t, st, keys)
+
+	manifestPath := filepath.Join(dir, "hash.mph")
+	if err := st.DumpToFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	st, err := LoadShardedTableFromFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkShardedLookups(t, st, keys)
+}
+
+func TestShardedTableGlobalIndex(t *testing.T) {
+	keys := sha1Keys(3000)
+	dir := t.TempDir()
+	st := buildShardedTable(t, filepath.Join(dir, "shards"), keys, 5)
+	manifestPath := filepath.Join(dir, "sharded.mph")
+	if err := st.DumpToFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadShardedTableFromFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, st := range []*ShardedReader{st, loaded} {
+		if st.NumKeys() != uint64(len(keys)) {
+			t.Fatalf("NumKeys: got %d; want %d", st.NumKeys(), len(keys))
+		}
+		seen := make([]bool, len(keys))
+		for _, key := range keys {
+			n, ok := st.Lookup(key)
+			if !ok {
+				t.Fatalf("Lookup(%x): got !ok; want ok", key)
+			}
+			if n >= uint64(len(keys)) || seen[n] {
+				t.Fatalf("Lookup(%x): got n=%d, out of range or already seen", key, n)
+			}
+			seen[n] = true
+
+			shard, local, ok := st.Locate(n)
+			if !ok {
+				t.Fatalf("Locate(%d): got !ok; want ok", n)
+			}
+			shardIdx, _ := st.shardIndex(key)
+			wantLocal, _ := st.tables[shardIdx].Lookup(key)
+			if uint64(shard) != shardIdx || local != wantLocal {
+				t.Errorf("Locate(%d): got (%d, %d); want (%d, %d)", n, shard, local, shardIdx, wantLocal)
+			}
+		}
+		if _, _, ok := st.Locate(uint64(len(keys))); ok {
+			t.Errorf("Locate(%d): got ok; want !ok", len(keys))
+		}
+	}
+}
+
+// TestShardedBuilderPutConcurrent is meant to be run with the race detector
+// enabled, as in go test -race.
+func TestShardedBuilderPutConcurrent(t *testing.T) {
+	const numProducers = 8
+	keys := sha1Keys(8000)
+	mphDir := t.TempDir()
+	b, err := NewShardedBuilder(sha1.Size, 3, 1024, mphDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, numProducers)
+	for p := 0; p < numProducers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := p; i < len(keys); i += numProducers {
+				if err := b.Put(keys[i]); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	st, err := b.Commit(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.NumKeys() != uint64(len(keys)) {
+		t.Errorf("NumKeys: got %d; want %d", st.NumKeys(), len(keys))
+	}
+	checkShardedLookups(t, st, keys)
+}
+
+func TestShardedBuilderMaxOpenFiles(t *testing.T) {
+	const (
+		maxOpenFiles = 4
+		numProducers = 4
+	)
+	keys := sha1Keys(20000)
+	b, err := NewShardedBuilder(sha1.Size, 6, 1<<16, t.TempDir(), WithMaxOpenFiles(maxOpenFiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	half := len(keys) / 2
+	for _, key := range keys[:half] {
+		if err = b.Put(key); err != nil {
+			t.Fatal(err)
+		}
+		if n := b.OpenFiles(); n > maxOpenFiles {
+			t.Fatalf("OpenFiles: got %d; want <= %d", n, maxOpenFiles)
+		}
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, numProducers)
+	for p := 0; p < numProducers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := half + p; i < len(keys); i += numProducers {
+				if err := b.Put(keys[i]); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if n := b.OpenFiles(); n > maxOpenFiles {
+		t.Fatalf("OpenFiles: got %d; want <= %d", n, maxOpenFiles)
+	}
+	// Files are reopened once per full buffer of 1<<16/64 bytes, not per key.
+	if maxOpens := len(keys)*sha1.Size/(1<<16/64) + 64; b.writers.opened > maxOpens {
+		t.Errorf("shard files opened %d times; want <= %d", b.writers.opened, maxOpens)
+	}
+
+	st, err := b.Commit(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if st.NumKeys() != uint64(len(keys)) {
+		t.Errorf("NumKeys: got %d; want %d", st.NumKeys(), len(keys))
+	}
+	checkShardedLookups(t, st, keys)
+	if n := st.OpenFiles(); n > maxOpenFiles {
+		t.Errorf("OpenFiles of the committed table: got %d; want <= %d", n, maxOpenFiles)
+	}
+}
+
+func TestShardedBuilderSmallBuffer(t *testing.T) {
+	keys := sha1Keys(20000)
+	// 1024 bytes split among 4096 shards would leave no room for a key.
+	b, err := NewShardedBuilder(sha1.Size, 12, 1024, t.TempDir(), WithMaxOpenFiles(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for _, key := range keys {
+		if err = b.Put(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if maxOpens := len(keys) / minTabBuffKeys; b.writers.opened > maxOpens {
+		t.Errorf("shard files opened %d times; want <= %d", b.writers.opened, maxOpens)
+	}
+}
+
+func TestShardedBuilderCommit(t *testing.T) {
+	keys := sha1Keys(5000)
+	b, err := NewShardedBuilder(sha1.Size, 4, 1024, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err = b.Put(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st, err := b.Commit(context.Background(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkShardedLookups(t, st, keys)
+	if _, err = b.Commit(context.Background(), 4); err != ErrCommitted {
+		t.Errorf("second Commit: got %v; want ErrCommitted", err)
+	}
+	if err = b.Put(keys[0]); err != ErrCommitted {
+		t.Errorf("Put after Commit: got %v; want ErrCommitted", err)
+	}
+}
+
+func TestShardedBuilderCommitRollback(t *testing.T) {
+	keys := sha1Keys(1000)
+	for _, tc := range []struct {
+		name  string
+		setup func(ctx context.CancelFunc, mphDir string)
+	}{
+		{"canceled", func(cancel context.CancelFunc, mphDir string) {
+			cancel()
+		}},
+		{"missing shard file", func(cancel context.CancelFunc, mphDir string) {
+			if err := os.Remove(filepath.Join(mphDir, "3.bin")); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mphDir := t.TempDir()
+			b, err := NewShardedBuilder(sha1.Size, 3, 1024, mphDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range keys {
+				if err = b.Put(key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tc.setup(cancel, mphDir)
+
+			if _, err = b.Commit(ctx, 2); err == nil {
+				t.Fatal("Commit: got nil error; want error")
+			}
+			entries := shardDirEntries(t, mphDir)
+			if len(entries) != 0 {
+				t.Errorf("shard dir after rollback: got %d entries; want none", len(entries))
+			}
+			if err = b.Put(keys[0]); err != ErrClosed {
+				t.Errorf("Put after failed commit: got %v; want ErrClosed", err)
+			}
+		})
+	}
+}
+
+func sha1Keys(numKeys int) [][]byte {
+	keys := make([][]byte, numKeys)
+	for i := range keys {
+		sum := sha1.Sum([]byte("key" + strconv.Itoa(i)))
+		keys[i] = sum[:]
+	}
+	return keys
+}
+
+func buildShardedTable(
+	t *testing.T,
+	mphDir string,
+	keys [][]byte,
+	prefBits int,
+	opts ...ShardOption,
+) *ShardedReader {
+	t.Helper()
+	if err := os.MkdirAll(mphDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewShardedBuilder(len(keys[0]), prefBits, 1024, mphDir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err = b.Put(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st, err := b.Commit(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// shardDirEntries returns the names of the entries of mphDir other than its
+// lock file.
+func shardDirEntries(t *testing.T, mphDir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(mphDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Name() != LockFileName {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+func checkShardedLookups(t *testing.T, st *ShardedReader, keys [][]byte) {
+	t.Helper()
+	for _, key := range keys {
+		if _, ok := st.Lookup(key); !ok {
+			t.Errorf("Lookup(%x): got !ok; want ok", key)
+		}
+	}
+}
+
+func TestShardedReaderClose(t *testing.T) {
+	keys := sha1Keys(1000)
+	dir := t.TempDir()
+	st := buildShardedTable(t, filepath.Join(dir, "shards"), keys, 3)
+
+	nonEmpty := 0
+	for _, cnt := range st.GetCounts() {
+		if cnt > 0 {
+			nonEmpty++
+		}
+	}
+	if got := st.OpenFiles(); got != nonEmpty {
+		t.Errorf("OpenFiles: got %d; want %d", got, nonEmpty)
+	}
+	if got := st.SizeInBytes(); got <= 0 {
+		t.Errorf("SizeInBytes: got %d; want > 0", got)
+	}
+
+	bundlePath := filepath.Join(dir, "sharded.bundle")
+	if err := st.DumpToBundle(bundlePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Close(); err != ErrClosed {
+		t.Errorf("second Close: got %v; want ErrClosed", err)
+	}
+	if _, ok := st.Lookup(keys[0]); ok {
+		t.Error("Lookup after Close: got ok; want !ok")
+	}
+	if got := st.OpenFiles(); got != 0 {
+		t.Errorf("OpenFiles after Close: got %d; want 0", got)
+	}
+
+	st, err := LoadShardedTableFromFile(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := st.OpenFiles(); got != 1 {
+		t.Errorf("OpenFiles of bundle: got %d; want 1", got)
+	}
+	if err = st.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShardedBuilderClose(t *testing.T) {
+	keys := sha1Keys(100)
+	mphDir := t.TempDir()
+	b, err := NewShardedBuilder(sha1.Size, 3, 1024, mphDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err = b.Put(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := b.OpenFiles(); got == 0 {
+		t.Error("OpenFiles before Close: got 0; want > 0")
+	}
+	if err = b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.OpenFiles(); got != 0 {
+		t.Errorf("OpenFiles after Close: got %d; want 0", got)
+	}
+	if err = b.Put(keys[0]); err != ErrClosed {
+		t.Errorf("Put after Close: got %v; want ErrClosed", err)
+	}
+	if _, err = b.Commit(context.Background(), 0); err != ErrClosed {
+		t.Errorf("Commit after Close: got %v; want ErrClosed", err)
+	}
+}
+
+func TestShardedReaderLazyLoading(t *testing.T) {
+	const maxResident = 3
+	keys := sha1Keys(4000)
+	dir := t.TempDir()
+	st := buildShardedTable(t, filepath.Join(dir, "shards"), keys, 4)
+	manifestPath := filepath.Join(dir, "sharded.mph")
+	if err := st.DumpToFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	bundlePath := filepath.Join(dir, "sharded.bundle")
+	if err := st.DumpToBundle(bundlePath); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filePath := range []string{manifestPath, bundlePath} {
+		lazy, err := LoadShardedTableFromFile(filePath, WithLazyLoading(maxResident))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := lazy.CacheStats(); s.Resident != 0 || s.Loads != 0 {
+			t.Errorf("%s: CacheStats before lookups: got %+v; want nothing loaded", filePath, s)
+		}
+
+		var wg sync.WaitGroup
+		for p := 0; p < 4; p++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for _, key := range keys {
+					want, _ := st.Lookup(key)
+					if got, ok := lazy.Lookup(key); !ok || got != want {
+						t.Errorf("%s: Lookup(%x): got (%d, %t); want (%d, true)", filePath, key, got, ok, want)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		s := lazy.CacheStats()
+		if s.Resident > maxResident || s.MaxResident != maxResident {
+			t.Errorf("%s: %d shards resident with max %d; want <= %d", filePath, s.Resident, s.MaxResident, maxResident)
+		}
+		if s.Loads < 16 || s.Evictions != s.Loads-uint64(s.Resident) || s.Hits == 0 {
+			t.Errorf("%s: unexpected CacheStats %+v", filePath, s)
+		}
+		if got := lazy.OpenFiles(); filePath == manifestPath && got != s.Resident {
+			t.Errorf("%s: OpenFiles: got %d; want %d", filePath, got, s.Resident)
+		}
+		if err = lazy.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestShardCacheConcurrentLoads(t *testing.T) {
+	unblock := make(chan struct{})
+	var loads [2]int
+	var mu sync.Mutex
+	c := newShardCache(2, 0, func(shardIdx uint64) (*Table, error) {
+		mu.Lock()
+		loads[shardIdx]++
+		mu.Unlock()
+		if shardIdx == 0 {
+			<-unblock
+		}
+		return Build(sha1Keys(10))
+	})
+
+	const numLookups = 4
+	got := make(chan *cachedShard, numLookups)
+	for i := 0; i < numLookups; i++ {
+		go func() {
+			cs, err := c.acquire(0)
+			if err != nil {
+				t.Error(err)
+			}
+			got <- cs
+		}()
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		ld := c.loading[0]
+		waiting := ld != nil && ld.waiters == numLookups-1
+		c.mu.Unlock()
+		if waiting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("lookups of shard 0 do not wait for its load")
+		}
+	}
+	// Other shards load while shard 0 is loading.
+	cs, err := c.acquire(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.release(cs)
+
+	close(unblock)
+	first := <-got
+	for i := 1; i < numLookups; i++ {
+		if cs := <-got; cs != first {
+			t.Errorf("lookup %d got another copy of shard 0", i)
+		}
+	}
+	if loads != [2]int{1, 1} {
+		t.Errorf("loads: got %v; want one per shard", loads)
+	}
+	if first.refs != numLookups {
+		t.Errorf("references to shard 0: got %d; want %d", first.refs, numLookups)
+	}
+	if err = c.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadShardedTableParallelErrors(t *testing.T) {
+	keys := sha1Keys(2000)
+	dir := t.TempDir()
+	mphDir := filepath.Join(dir, "shards")
+	st := buildShardedTable(t, mphDir, keys, 3)
+	manifestPath := filepath.Join(dir, "sharded.mph")
+	if err := st.DumpToFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadShardedTableFromFile(manifestPath, WithLoadParallelism(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkShardedLookups(t, loaded, keys)
+	loaded.Close()
+
+	var removed []string
+	for _, shard := range []int{2, 5} {
+		tabFilePath := filepath.Join(mphDir, strconv.Itoa(shard)+".bin")
+		if err = os.Remove(tabFilePath); err != nil {
+			t.Fatal(err)
+		}
+		removed = append(removed, "shard "+strconv.Itoa(shard)+" ("+tabFilePath+")")
+	}
+	_, err = LoadShardedTableFromFile(manifestPath, WithLoadParallelism(4))
+	if err == nil {
+		t.Fatal("LoadShardedTableFromFile with missing shards: got nil error; want error")
+	}
+	for _, want := range removed {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
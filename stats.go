@@ -0,0 +1,176 @@
+package mph
+
+import (
+	"math"
+	"math/bits"
+	"slices"
+	"time"
+)
+
+// TableStats describes the structure of a Table.
+type TableStats struct {
+	NumKeys    int
+	Level0Len  int     // number of level0 buckets
+	Level1Len  int     // number of level1 slots
+	EmptySlots int     // level1 slots that hold no key
+	BitsPerKey float64 // size of level0 and level1 in bits per key
+
+	// MaxSeed is the largest seed stored in level0, and SeedHist[i] counts the
+	// level0 buckets whose seed needs i bits, so SeedHist[0] counts the
+	// buckets that were placed with seed 0.
+	MaxSeed  uint32
+	SeedHist []int
+
+	// BucketSizes[i] counts the level0 buckets that hold i keys, and
+	// BuildTime is how long the table took to build. Both are only known for
+	// tables returned by Build and BuildFromFile, and are zero for tables that
+	// were loaded from a dump.
+	BucketSizes []int
+	BuildTime   time.Duration
+}
+
+// Stats returns statistics about the structure of t.
+func (t *Table) Stats() TableStats {
+	s := TableStats{
+		NumKeys:     t.numKeys,
+		Level0Len:   len(t.level0),
+		Level1Len:   len(t.level1),
+		EmptySlots:  len(t.level1) - t.numKeys,
+		BucketSizes: t.bucketSizes,
+		BuildTime:   t.buildTime,
+	}
+	if t.numKeys > 0 {
+		s.BitsPerKey = float64(32*(len(t.level0)+len(t.level1))) / float64(t.numKeys)
+	}
+	for _, seed := range t.level0 {
+		n := bits.Len32(seed)
+		for len(s.SeedHist) <= n {
+			s.SeedHist = append(s.SeedHist, 0)
+		}
+		s.SeedHist[n]++
+		s.MaxSeed = max(s.MaxSeed, seed)
+	}
+	return s
+}
+
+// bucketSizeHistogram counts the level0 buckets of each size, given the
+// non-empty buckets sorted by decreasing size.
+func bucketSizeHistogram(buckets []indexBucket, numBuckets int) []int {
+	if len(buckets) == 0 {
+		return []int{numBuckets}
+	}
+	hist := make([]int, len(buckets[0].vals)+1)
+	hist[0] = numBuckets - len(buckets)
+	for _, bucket := range buckets {
+		hist[len(bucket.vals)]++
+	}
+	return hist
+}
+
+// ShardedStats describes the structure of a sharded table and how evenly its
+// keys are spread over the shards.
+type ShardedStats struct {
+	NumShards      int
+	NonEmptyShards int
+	NumKeys        uint64
+
+	// Distribution of the per-shard key counts over all shards, including
+	// empty ones.
+	MinCount    uint
+	MaxCount    uint
+	MedianCount uint
+	MeanCount   float64
+	StdDev      float64
+
+	// Skew is MaxCount / MeanCount, and ShardSkew[i] is the key count of shard
+	// i divided by MeanCount. A perfectly balanced table has a skew of 1.
+	Skew      float64
+	ShardSkew []float64
+
+	// BitsPerKey is the size of all shards' level0 and level1 in bits per key,
+	// and BuildTime is the total time spent building shards, if known.
+	BitsPerKey float64
+	BuildTime  time.Duration
+
+	// Shards holds the statistics of every shard. It is only set for
+	// ShardedReaders, and the entries of empty shards, and of shards that are
+	// not loaded, are zero. BitsPerKey only covers the loaded shards.
+	Shards []TableStats
+}
+
+// Stats returns statistics about the key distribution of r and the structure
+// of its shards.
+func (r *ShardedReader) Stats() ShardedStats {
+	s := countStats(r.counts)
+	if r.closed {
+		return s
+	}
+	var tableBits int
+	var tableKeys int
+	s.Shards = make([]TableStats, len(r.counts))
+	r.loadedShards(func(shardIdx uint64, table *Table) {
+		ts := table.Stats()
+		s.Shards[shardIdx] = ts
+		s.BuildTime += ts.BuildTime
+		tableBits += 32 * (ts.Level0Len + ts.Level1Len)
+		tableKeys += ts.NumKeys
+	})
+	if tableKeys > 0 {
+		s.BitsPerKey = float64(tableBits) / float64(tableKeys)
+	}
+	return s
+}
+
+// countStats returns the statistics derived from the per-shard key counts.
+func countStats(counts []uint) ShardedStats {
+	s := ShardedStats{NumShards: len(counts)}
+	if len(counts) == 0 {
+		return s
+	}
+	s.MinCount = counts[0]
+	for _, cnt := range counts {
+		s.NumKeys += uint64(cnt)
+		s.MinCount = min(s.MinCount, cnt)
+		s.MaxCount = max(s.MaxCount, cnt)
+		if cnt > 0 {
+			s.NonEmptyShards++
+		}
+	}
+	s.MeanCount = float64(s.NumKeys) / float64(len(counts))
+	var sqDiffs float64
+	for _, cnt := range counts {
+		sqDiffs += (float64(cnt) - s.MeanCount) * (float64(cnt) - s.MeanCount)
+	}
+	s.StdDev = math.Sqrt(sqDiffs / float64(len(counts)))
+	sorted := slices.Clone(counts)
+	slices.Sort(sorted)
+	s.MedianCount = sorted[len(sorted)/2]
+	if s.MeanCount > 0 {
+		s.Skew = float64(s.MaxCount) / s.MeanCount
+		s.ShardSkew = make([]float64, len(counts))
+		for i, cnt := range counts {
+			s.ShardSkew[i] = float64(cnt) / s.MeanCount
+		}
+	}
+	return s
+}
+
+// ShardCacheStats reports the activity of the shard cache of a ShardedReader
+// loaded with WithLazyLoading.
+type ShardCacheStats struct {
+	Resident    int // shards currently loaded
+	MaxResident int // cap on loaded shards, or 0 if unbounded
+	Hits        uint64
+	Loads       uint64
+	Evictions   uint64
+	LoadErrors  uint64
+}
+
+// CacheStats returns the activity of the shard cache of r. It returns zero
+// stats if r loaded all its shards up front.
+func (r *ShardedReader) CacheStats() ShardCacheStats {
+	if r.cache == nil {
+		return ShardCacheStats{}
+	}
+	return r.cache.cacheStats()
+}
@@ -0,0 +1,70 @@
+package mph
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestTableStats(t *testing.T) {
+	keys := make([][]byte, 10000)
+	for i := range keys {
+		keys[i] = []byte(strconv.Itoa(i))
+	}
+	tbl, err := Build(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := tbl.Stats()
+	if s.NumKeys != len(keys) {
+		t.Errorf("NumKeys: got %d; want %d", s.NumKeys, len(keys))
+	}
+	if s.Level1Len < len(keys) || s.EmptySlots != s.Level1Len-len(keys) {
+		t.Errorf("Level1Len=%d EmptySlots=%d inconsistent with %d keys", s.Level1Len, s.EmptySlots, len(keys))
+	}
+	if want := float64(32*(s.Level0Len+s.Level1Len)) / float64(len(keys)); s.BitsPerKey != want {
+		t.Errorf("BitsPerKey: got %v; want %v", s.BitsPerKey, want)
+	}
+	var buckets, bucketKeys, seeds int
+	for size, n := range s.BucketSizes {
+		buckets += n
+		bucketKeys += size * n
+	}
+	for _, n := range s.SeedHist {
+		seeds += n
+	}
+	if buckets != s.Level0Len || seeds != s.Level0Len {
+		t.Errorf("histograms cover %d buckets and %d seeds; want %d", buckets, seeds, s.Level0Len)
+	}
+	if bucketKeys != len(keys) {
+		t.Errorf("BucketSizes covers %d keys; want %d", bucketKeys, len(keys))
+	}
+	if s.BuildTime <= 0 {
+		t.Errorf("BuildTime: got %v; want > 0", s.BuildTime)
+	}
+}
+
+func TestShardedReaderStats(t *testing.T) {
+	keys := sha1Keys(4000)
+	st := buildShardedTable(t, filepath.Join(t.TempDir(), "shards"), keys, 4)
+	s := st.Stats()
+	if s.NumShards != 16 || s.NumKeys != uint64(len(keys)) {
+		t.Fatalf("got %d shards and %d keys; want 16 and %d", s.NumShards, s.NumKeys, len(keys))
+	}
+	if s.MeanCount != float64(len(keys))/16 {
+		t.Errorf("MeanCount: got %v; want %v", s.MeanCount, float64(len(keys))/16)
+	}
+	if s.MinCount > s.MedianCount || s.MedianCount > s.MaxCount {
+		t.Errorf("Min/Median/Max out of order: %d/%d/%d", s.MinCount, s.MedianCount, s.MaxCount)
+	}
+	if s.Skew < 1 || len(s.ShardSkew) != 16 {
+		t.Errorf("Skew=%v len(ShardSkew)=%d; want >= 1 and 16", s.Skew, len(s.ShardSkew))
+	}
+	var shardKeys int
+	for _, ts := range s.Shards {
+		shardKeys += ts.NumKeys
+	}
+	if shardKeys != len(keys) {
+		t.Errorf("Shards cover %d keys; want %d", shardKeys, len(keys))
+	}
+}
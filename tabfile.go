@@ -0,0 +1,300 @@
+package mph
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"unsafe"
+)
+
+// DefaultMaxOpenFiles is the number of shard keys files a ShardedBuilder keeps
+// open during ingestion unless configured with WithMaxOpenFiles.
+const DefaultMaxOpenFiles = 1024
+
+// A tabFile is the buffered writer of one shard's keys file. Keys are
+// collected in an in-memory buffer, and the file is only opened when the
+// buffer fills or is flushed. mu serializes writes to the shard and updates of
+// its count, as well as opening and closing the file.
+type tabFile struct {
+	tw      *tabWriters
+	path    string
+	file    *os.File      // nil unless open
+	buff    []byte        // keys not yet written to the file
+	created bool          // the file has been created and truncated
+	dirty   bool          // the file was written to since it was last synced
+	elem    *list.Element // position in tabWriters.lru, nil if not listed
+	mu      sync.Mutex
+}
+
+func (tf *tabFile) Name() string {
+	return tf.path
+}
+
+func (tf *tabFile) open() error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !tf.created {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(tf.path, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open table file %s: %v", tf.path, err)
+	}
+	tf.file = f
+	tf.created = true
+	return nil
+}
+
+// Write appends p to the buffer of tf, writing the buffer to the file when it
+// is full. Writes larger than the buffer go to the file directly.
+func (tf *tabFile) Write(p []byte) (n int, err error) {
+	if tf.buff == nil {
+		tf.buff = make([]byte, 0, tf.tw.buffSzBytes)
+	}
+	if len(tf.buff)+len(p) > cap(tf.buff) {
+		if err = tf.flush(); err != nil {
+			return 0, err
+		}
+	}
+	if len(p) > cap(tf.buff) {
+		return tf.writeFile(p)
+	}
+	tf.buff = append(tf.buff, p...)
+	return len(p), nil
+}
+
+// flush writes the buffer of tf to its file.
+func (tf *tabFile) flush() error {
+	if len(tf.buff) == 0 {
+		return nil
+	}
+	if _, err := tf.writeFile(tf.buff); err != nil {
+		return err
+	}
+	tf.buff = tf.buff[:0]
+	return nil
+}
+
+// writeFile writes p to the file of tf, opening it if needed.
+func (tf *tabFile) writeFile(p []byte) (int, error) {
+	if tf.file == nil {
+		if err := tf.tw.open(tf); err != nil {
+			return 0, err
+		}
+	} else {
+		tf.tw.touch(tf)
+	}
+	tf.dirty = true
+	return tf.file.Write(p)
+}
+
+// sync flushes tf and commits its file to stable storage if it was written
+// to since it was last synced, reopening the file if it is closed.
+func (tf *tabFile) sync() error {
+	if err := tf.flush(); err != nil {
+		return err
+	}
+	if !tf.dirty {
+		return nil
+	}
+	var err error
+	if tf.file != nil {
+		err = tf.file.Sync()
+	} else {
+		err = syncFile(tf.path)
+	}
+	if err != nil {
+		return err
+	}
+	tf.dirty = false
+	return nil
+}
+
+// closeFile closes the file of tf if it is open, keeping its buffer.
+func (tf *tabFile) closeFile() error {
+	if tf.file == nil {
+		return nil
+	}
+	err := tf.file.Close()
+	tf.file = nil
+	return err
+}
+
+// tabWriters holds the writers of the shards of a ShardedBuilder under
+// construction. Every writer has a buffer of an equal share of the total
+// buffer size, so a shard file is only written to once per buffer of keys. At
+// most maxOpen files are open at any time: the least recently written file is
+// closed to make room for another, and is reopened in append mode when its
+// buffer next fills.
+type tabWriters struct {
+	dirPath     string
+	buffSzBytes int // per writer
+	maxOpen     int
+	files       []*tabFile
+	mu          sync.Mutex // guards files entries, lru, numOpen and opened
+	cond        *sync.Cond // signaled when lru or numOpen change
+	lru         *list.List // writers with an open file, most recently used first
+	numOpen     int        // open files plus files being opened
+	opened      int        // files opened so far
+}
+
+// minTabBuffKeys is the number of keys that the buffer of every shard holds
+// at least, so that shard files are not reopened for every key when the
+// buffer size is small for the number of shards.
+const minTabBuffKeys = 16
+
+func newTabWriters(dirPath string, numTabs, keyLen, buffSzBytes, maxOpen int) *tabWriters {
+	tw := &tabWriters{
+		dirPath:     dirPath,
+		buffSzBytes: max(buffSzBytes/numTabs, minTabBuffKeys*keyLen),
+		maxOpen:     maxOpen,
+		files:       make([]*tabFile, numTabs),
+		lru:         list.New(),
+	}
+	tw.cond = sync.NewCond(&tw.mu)
+	return tw
+}
+
+// acquire returns the writer of shard shardIdx with its lock held. The caller
+// must unlock it once done writing.
+func (tw *tabWriters) acquire(shardIdx uint64) *tabFile {
+	tw.mu.Lock()
+	tf := tw.files[shardIdx]
+	if tf == nil {
+		tf = tw.newTabFile(path.Join(tw.dirPath, fmt.Sprintf("%d.bin", shardIdx)))
+		tw.files[shardIdx] = tf
+	}
+	tw.mu.Unlock()
+	tf.mu.Lock()
+	return tf
+}
+
+// newTabFile returns a writer of the keys file at filePath.
+func (tw *tabWriters) newTabFile(filePath string) *tabFile {
+	return &tabFile{tw: tw, path: filePath}
+}
+
+func (tw *tabWriters) touch(tf *tabFile) {
+	if len(tw.files) <= tw.maxOpen {
+		return
+	}
+	tw.mu.Lock()
+	if tf.elem != nil {
+		tw.lru.MoveToFront(tf.elem)
+	}
+	tw.mu.Unlock()
+}
+
+// open opens the file of tf, whose lock is held, evicting the least recently
+// used writer if needed. Writers are only listed in lru while their file is
+// open, so tf is never picked as its own victim and the lock of a victim is
+// only ever awaited by a goroutine that holds no other writer's lock but its
+// own unlisted one.
+func (tw *tabWriters) open(tf *tabFile) error {
+	tw.mu.Lock()
+	for tw.numOpen >= tw.maxOpen && tw.lru.Len() == 0 {
+		tw.cond.Wait()
+	}
+	var victim *tabFile
+	if tw.numOpen >= tw.maxOpen {
+		victim = tw.lru.Remove(tw.lru.Back()).(*tabFile)
+		victim.elem = nil
+	} else {
+		tw.numOpen++
+	}
+	tw.mu.Unlock()
+
+	if victim != nil {
+		victim.mu.Lock()
+		err := victim.closeFile()
+		victim.mu.Unlock()
+		if err != nil {
+			tw.release()
+			return err
+		}
+	}
+	if err := tf.open(); err != nil {
+		tw.release()
+		return err
+	}
+
+	tw.mu.Lock()
+	tw.opened++
+	tf.elem = tw.lru.PushFront(tf)
+	tw.cond.Broadcast()
+	tw.mu.Unlock()
+	return nil
+}
+
+// release gives up an open file slot that was not used.
+func (tw *tabWriters) release() {
+	tw.mu.Lock()
+	tw.numOpen--
+	tw.cond.Broadcast()
+	tw.mu.Unlock()
+}
+
+// closeAll flushes all writers and closes their files.
+func (tw *tabWriters) closeAll() error {
+	var errs []error
+	for _, tf := range tw.files {
+		if tf != nil {
+			errs = append(errs, tf.flush(), tf.closeFile())
+			tf.buff = nil
+			tf.elem = nil
+		}
+	}
+	tw.lru.Init()
+	tw.numOpen = 0
+	return errors.Join(errs...)
+}
+
+// syncAll flushes every writer and commits the shard files written to since
+// the last call, whether open or not, and the shard directory to stable
+// storage.
+func (tw *tabWriters) syncAll() error {
+	var errs []error
+	for _, tf := range tw.files {
+		if tf == nil {
+			continue
+		}
+		tf.mu.Lock()
+		errs = append(errs, tf.sync())
+		tf.mu.Unlock()
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	return syncDir(tw.dirPath)
+}
+
+// syncFile commits the file at filePath to stable storage.
+func syncFile(filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func (tw *tabWriters) openFiles() int {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	return tw.lru.Len()
+}
+
+func (tw *tabWriters) sizeInBytes() int64 {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	size := int64(unsafe.Sizeof(*tw))
+	size += int64(unsafe.Sizeof((*tabFile)(nil))) * int64(cap(tw.files))
+	for _, tf := range tw.files {
+		if tf != nil {
+			size += int64(unsafe.Sizeof(*tf)) + int64(len(tf.path)) + int64(cap(tf.buff))
+		}
+	}
+	return size
+}
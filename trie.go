@@ -0,0 +1,292 @@
+package mph
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// keyBit returns bit bitIdx of key, counting from the most significant bit of
+// its first byte.
+func keyBit(key []byte, bitIdx int) (int, error) {
+	if bitIdx >= 8*len(key) {
+		return 0, fmt.Errorf("key too short for bit %d", bitIdx)
+	}
+	return int(key[bitIdx>>3]>>(7-bitIdx&7)) & 1, nil
+}
+
+// resolveShard follows the trie below top-level shard shardIdx to the shard
+// that key belongs to. Shards that exceed the key budget of the builder are
+// split in two on the next key bit, recursively. roots holds the reference of
+// every top-level shard and nodes the references of the two children of every
+// split node: a reference r >= 0 names shard r, and r < 0 names node ^r.
+func (sr *shardRouter) resolveShard(key []byte, shardIdx uint64) (uint64, error) {
+	if sr.roots == nil {
+		return shardIdx, nil
+	}
+	ref := sr.roots[shardIdx]
+	for bitIdx := sr.prefBits; ref < 0; bitIdx++ {
+		bit, err := keyBit(key, bitIdx)
+		if err != nil {
+			return 0, err
+		}
+		ref = sr.nodes[^ref][bit]
+	}
+	return uint64(ref), nil
+}
+
+// leafShards returns the shards under top-level shard shardIdx, in order.
+func (sr *shardRouter) leafShards(shardIdx uint64) []uint64 {
+	if sr.roots == nil {
+		return []uint64{shardIdx}
+	}
+	var leaves []uint64
+	var add func(ref int32)
+	add = func(ref int32) {
+		if ref >= 0 {
+			leaves = append(leaves, uint64(ref))
+			return
+		}
+		for _, child := range sr.nodes[^ref] {
+			add(child)
+		}
+	}
+	add(sr.roots[shardIdx])
+	return leaves
+}
+
+// checkTrie returns an error unless roots and nodes form a valid trie over
+// numShards shards for 2^prefBits top-level shards.
+func checkTrie(roots []int32, nodes [][2]int32, prefBits, numShards int) error {
+	if roots == nil {
+		if len(nodes) > 0 || numShards != 1<<prefBits {
+			return fmt.Errorf("manifest has %d shards for %d prefix bits", numShards, prefBits)
+		}
+		return nil
+	}
+	if len(roots) != 1<<prefBits {
+		return fmt.Errorf("manifest has %d trie roots for %d prefix bits", len(roots), prefBits)
+	}
+	checkRef := func(ref int32, minNode int) error {
+		if ref >= int32(numShards) || (ref < 0 && (int(^ref) < minNode || int(^ref) >= len(nodes))) {
+			return fmt.Errorf("manifest trie reference %d out of range", ref)
+		}
+		return nil
+	}
+	for _, ref := range roots {
+		if err := checkRef(ref, 0); err != nil {
+			return err
+		}
+	}
+	for n, children := range nodes {
+		for _, ref := range children {
+			if err := checkRef(ref, n+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// A shardNode is a shard being built by a ShardedBuilder: either a leaf with
+// its keys file and table, or a shard that was split in two.
+type shardNode struct {
+	path     string // empty for empty shards
+	count    uint
+	table    *Table
+	children []*shardNode
+}
+
+// buildShard builds the count keys in tabFilePath into a shard, first
+// splitting it on bit bitIdx and below if it holds more than the key budget
+// of b. It returns the node even on failure so that its files can be removed.
+func (b *ShardedBuilder) buildShard(tabFilePath string, count uint, bitIdx int) (*shardNode, error) {
+	node := &shardNode{path: tabFilePath, count: count}
+	if count == 0 {
+		return node, nil
+	}
+	if b.maxShardKeys == 0 || count <= b.maxShardKeys {
+		tFile, err := os.Open(tabFilePath)
+		if err != nil {
+			return node, err
+		}
+		node.table, err = BuildFromFile(tFile, b.keyLen)
+		if err != nil {
+			tFile.Close()
+			return node, err
+		}
+		return node, nil
+	}
+	if bitIdx >= 8*b.keyLen {
+		return node, fmt.Errorf("cannot split %d keys below %d (duplicate keys?)", count, b.maxShardKeys)
+	}
+
+	var err error
+	if node.children, err = b.splitShard(tabFilePath, count, bitIdx); err != nil {
+		return node, err
+	}
+	for j, child := range node.children {
+		if node.children[j], err = b.buildShard(child.path, child.count, bitIdx+1); err != nil {
+			return node, err
+		}
+	}
+	return node, nil
+}
+
+// splitShard copies the count keys in tabFilePath to two new keys files by
+// bit bitIdx of every key. Children that get no keys have no file.
+// tabFilePath is only removed once the whole top-level shard is built, see
+// finishShard, so that an interrupted build can split it again.
+func (b *ShardedBuilder) splitShard(tabFilePath string, count uint, bitIdx int) ([]*shardNode, error) {
+	children := make([]*shardNode, 2)
+	writers := make([]*bufio.Writer, 2)
+	files := make([]*os.File, 2)
+	base := strings.TrimSuffix(tabFilePath, ".bin")
+	for j := range children {
+		children[j] = &shardNode{path: fmt.Sprintf("%s.%d.bin", base, j)}
+		f, err := os.Create(children[j].path)
+		if err != nil {
+			for _, f := range files[:j] {
+				f.Close()
+			}
+			return children, err
+		}
+		files[j] = f
+		writers[j] = bufio.NewWriter(f)
+	}
+
+	err := b.distributeKeys(tabFilePath, count, bitIdx, children, writers)
+	for j, f := range files {
+		if flushErr := writers[j].Flush(); err == nil {
+			err = flushErr
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return children, err
+	}
+	for _, child := range children {
+		if child.count == 0 {
+			os.Remove(child.path)
+			child.path = ""
+		}
+	}
+	return children, nil
+}
+
+func (b *ShardedBuilder) distributeKeys(
+	tabFilePath string,
+	count uint,
+	bitIdx int,
+	children []*shardNode,
+	writers []*bufio.Writer,
+) error {
+	tFile, err := os.Open(tabFilePath)
+	if err != nil {
+		return err
+	}
+	defer tFile.Close()
+	src := bufio.NewReader(tFile)
+	key := make([]byte, b.keyLen)
+	for i := uint(0); i < count; i++ {
+		if _, err = io.ReadFull(src, key); err != nil {
+			return err
+		}
+		bit, err := keyBit(key, bitIdx)
+		if err != nil {
+			return err
+		}
+		if _, err = writers[bit].Write(key); err != nil {
+			return err
+		}
+		children[bit].count++
+	}
+	return nil
+}
+
+// closeShardNode closes the tables of the shards under node.
+func closeShardNode(node *shardNode) {
+	if node == nil {
+		return
+	}
+	if node.table != nil {
+		node.table.Close()
+	}
+	for _, child := range node.children {
+		closeShardNode(child)
+	}
+}
+
+// releaseShardNode dumps the tables of the shards under node to their keys
+// files and closes them, so that they can be loaded again from the files.
+func releaseShardNode(node *shardNode) error {
+	if node.table != nil {
+		err := node.table.DumpToKeysFile()
+		if cerr := node.table.Close(); err == nil {
+			err = cerr
+		}
+		node.table = nil
+		return err
+	}
+	for _, child := range node.children {
+		if err := releaseShardNode(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeShardNode closes the tables of the shards under node and removes
+// their files.
+func removeShardNode(node *shardNode) {
+	if node == nil {
+		return
+	}
+	if node.table != nil {
+		node.table.Close()
+	}
+	if node.path != "" {
+		os.Remove(node.path)
+	}
+	for _, child := range node.children {
+		removeShardNode(child)
+	}
+}
+
+// setShards numbers the leaves under the top-level shards roots, in order,
+// as the shards of r, and records the trie if any shard was split.
+func (r *ShardedReader) setShards(roots []*shardNode) {
+	var split bool
+	var add func(node *shardNode) int32
+	add = func(node *shardNode) int32 {
+		if node == nil || node.children == nil {
+			if node == nil {
+				node = &shardNode{}
+			}
+			r.counts = append(r.counts, node.count)
+			r.tables = append(r.tables, node.table)
+			r.tabFilePaths = append(r.tabFilePaths, node.path)
+			return int32(len(r.counts) - 1)
+		}
+		split = true
+		n := len(r.nodes)
+		r.nodes = append(r.nodes, [2]int32{})
+		for j, child := range node.children {
+			ref := add(child)
+			r.nodes[n][j] = ref
+		}
+		return ^int32(n)
+	}
+	refs := make([]int32, len(roots))
+	for i, node := range roots {
+		refs[i] = add(node)
+	}
+	if split {
+		r.roots = refs
+	}
+	r.offsets = prefixSums(r.counts)
+}
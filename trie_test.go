@@ -0,0 +1,84 @@
+package mph
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestShardedBuilderMaxShardKeys(t *testing.T) {
+	const maxShardKeys = 100
+	// Most keys share their first byte, which overloads one prefix shard.
+	keys := sha1Keys(3000)
+	for _, key := range keys[:2400] {
+		key[0] = 0x42
+	}
+	dir := t.TempDir()
+	st := buildShardedTable(t, filepath.Join(dir, "shards"), keys, 3, WithMaxShardKeys(maxShardKeys))
+	if st.roots == nil {
+		t.Fatal("no shard was split")
+	}
+	for shard, cnt := range st.GetCounts() {
+		if cnt > maxShardKeys {
+			t.Errorf("shard %d: got %d keys; want <= %d", shard, cnt, maxShardKeys)
+		}
+	}
+	checkShardedLookups(t, st, keys)
+	seen := make([]bool, len(keys))
+	for _, key := range keys {
+		n, _ := st.Lookup(key)
+		if seen[n] {
+			t.Fatalf("Lookup(%x): index %d already seen", key, n)
+		}
+		seen[n] = true
+	}
+
+	manifestPath := filepath.Join(dir, "sharded.mph")
+	if err := st.DumpToFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	bundlePath := filepath.Join(dir, "sharded.bundle")
+	if err := st.DumpToBundle(bundlePath); err != nil {
+		t.Fatal(err)
+	}
+	for _, filePath := range []string{manifestPath, bundlePath} {
+		loaded, err := LoadShardedTableFromFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			want, _ := st.Lookup(key)
+			if got, ok := loaded.Lookup(key); !ok || got != want {
+				t.Fatalf("%s: Lookup(%x): got (%d, %t); want (%d, true)", filePath, key, got, ok, want)
+			}
+		}
+		loaded.Close()
+	}
+}
+
+func TestShardedBuilderMaxShardKeysDuplicates(t *testing.T) {
+	mphDir := t.TempDir()
+	b, err := NewShardedBuilder(2, 1, 1024, mphDir, WithMaxShardKeys(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range [][]byte{{1, 2}, {1, 2}, {200, 3}} {
+		if err = b.Put(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = b.Commit(context.Background(), 0); err == nil {
+		t.Fatal("Commit with duplicate keys: got nil error; want error")
+	}
+	entries := shardDirEntries(t, mphDir)
+	if len(entries) != 0 {
+		t.Errorf("shard dir after rollback: got %d entries; want none", len(entries))
+	}
+}
+
+func TestShardedBuilderMaxShardKeysByHash(t *testing.T) {
+	_, err := NewShardedBuilder(20, 3, 1024, t.TempDir(), WithShardMode(ShardByHash), WithMaxShardKeys(100))
+	if err == nil {
+		t.Error("NewShardedBuilder with a key budget and ShardByHash: got nil error; want error")
+	}
+}
@@ -0,0 +1,297 @@
+package mph
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrManifestChanged is returned by ShardedUpdater.Commit when the manifest of
+// the table was replaced since the updater was created.
+var ErrManifestChanged = errors.New("mph: manifest changed since the updater was created")
+
+// A ShardedUpdater adds keys to a sharded table that was dumped with
+// DumpToFile. On Commit it rebuilds only the shards that received keys and
+// replaces the manifest; the keys files of the other shards are left
+// untouched.
+type ShardedUpdater struct {
+	base         *ShardedReader // shards are not loaded
+	manifest     *shardManifest // as read by NewShardedUpdater
+	manifestPath string
+	opts         []LoadOption
+	mu           sync.Mutex // guards added, committed and closed
+	added        map[uint64][][]byte
+	committed    bool
+	closed       bool
+}
+
+// NewShardedUpdater returns an updater for the table whose manifest is at
+// manifestPath. opts are used to resolve the paths of the manifest and to load
+// the ShardedReader returned by Commit.
+func NewShardedUpdater(manifestPath string, opts ...LoadOption) (*ShardedUpdater, error) {
+	m, mphDirPath, tabFilePaths, err := openIndex(manifestPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	base, err := newShardedReaderFromManifest(m)
+	if err != nil {
+		return nil, err
+	}
+	base.mphDirPath = mphDirPath
+	base.tabFilePaths = tabFilePaths
+	return &ShardedUpdater{
+		base:         base,
+		manifest:     m,
+		manifestPath: manifestPath,
+		opts:         opts,
+		added:        make(map[uint64][][]byte),
+	}, nil
+}
+
+// Put adds key to the shard it belongs to. Put may be called from several
+// goroutines at once. Keys are held in memory until Commit.
+func (u *ShardedUpdater) Put(key []byte) error {
+	if len(key) != u.base.keyLen {
+		return fmt.Errorf("invalid key length %d, expected %d", len(key), u.base.keyLen)
+	}
+	shardIdx, err := u.base.shardIndex(key)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err = u.checkOpen(); err != nil {
+		return err
+	}
+	u.added[shardIdx] = append(u.added[shardIdx], append([]byte(nil), key...))
+	return nil
+}
+
+func (u *ShardedUpdater) checkOpen() error {
+	if u.closed {
+		return ErrClosed
+	}
+	if u.committed {
+		return ErrCommitted
+	}
+	return nil
+}
+
+// Commit rebuilds the shards that received keys, at most parallelism at a
+// time, or GOMAXPROCS at a time if parallelism is not positive. Every rebuilt
+// shard is written to a new keys file, and the manifest is then atomically
+// replaced by one that refers to the new files, so readers of the manifest see
+// either the old or the new table. The old keys files of the rebuilt shards
+// are left in place for readers of the old manifest, including lazily loaded
+// ones, and can be removed with CollectGarbage once those are closed. The
+// shard directory is locked meanwhile, see NewShardedBuilder. Commit returns
+// the updated table, loaded with the options given to NewShardedUpdater.
+//
+// Rebuilding a shard changes the indexes returned by ShardedReader.Lookup of
+// its keys and of the keys of all the shards after it, which are shifted by
+// the number of keys added before them. Indexes stored elsewhere must be
+// recomputed after Commit.
+//
+// Commit fails without changing the table if a key was already present or
+// was put twice, if a shard fails to build or if ctx is canceled. It returns
+// ErrManifestChanged if the manifest was replaced since the updater was
+// created, for instance by another updater. The updater cannot be used after
+// Commit, whether it succeeded or not.
+func (u *ShardedUpdater) Commit(ctx context.Context, parallelism int) (*ShardedReader, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.checkOpen(); err != nil {
+		return nil, err
+	}
+	u.committed = true
+	lock, err := lockDir(u.base.mphDirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+	cur, err := readManifest(u.manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(cur, u.manifest) {
+		return nil, ErrManifestChanged
+	}
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+
+	next := *u.base
+	next.counts = append([]uint(nil), u.base.counts...)
+	next.tabFilePaths = append([]string(nil), u.base.tabFilePaths...)
+	if u.base.checksums != nil {
+		next.checksums = append([]uint32(nil), u.base.checksums...)
+	}
+	var mu sync.Mutex // guards next
+	var created []string
+	grp, grpCtx := errgroup.WithContext(ctx)
+	grp.SetLimit(parallelism)
+	for shardIdx, keys := range u.added {
+		if grpCtx.Err() != nil {
+			break
+		}
+		grp.Go(func() error {
+			if err := grpCtx.Err(); err != nil {
+				return err
+			}
+			tabFilePath, cnt, err := u.rebuildShard(shardIdx, keys)
+			if tabFilePath != "" {
+				mu.Lock()
+				created = append(created, tabFilePath)
+				mu.Unlock()
+			}
+			if err != nil {
+				return fmt.Errorf("shard %d: %v", shardIdx, err)
+			}
+			var sum uint32
+			if next.checksums != nil {
+				if sum, err = fileChecksum(tabFilePath); err != nil {
+					return fmt.Errorf("shard %d: %v", shardIdx, err)
+				}
+			}
+			mu.Lock()
+			next.counts[shardIdx] = cnt
+			next.tabFilePaths[shardIdx] = tabFilePath
+			if next.checksums != nil {
+				next.checksums[shardIdx] = sum
+			}
+			mu.Unlock()
+			return nil
+		})
+	}
+	err = grp.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = next.fillChecksums()
+	}
+	var m *shardManifest
+	if err == nil {
+		m, err = next.manifest(filepath.Dir(u.manifestPath))
+	}
+	if err == nil {
+		err = writeManifest(u.manifestPath, m)
+	}
+	if err != nil {
+		for _, tabFilePath := range created {
+			os.Remove(tabFilePath)
+		}
+		return nil, err
+	}
+	return LoadShardedTableFromFile(u.manifestPath, u.opts...)
+}
+
+// rebuildShard writes the keys of shard shardIdx followed by keys to a new
+// keys file, builds the shard from it and dumps it. It returns the path of the
+// new file, if one was created, and the new key count of the shard.
+func (u *ShardedUpdater) rebuildShard(shardIdx uint64, keys [][]byte) (string, uint, error) {
+	if err := u.checkNewKeys(shardIdx, keys); err != nil {
+		return "", 0, err
+	}
+	tmpFile, err := os.CreateTemp(u.base.mphDirPath, strconv.FormatUint(shardIdx, 10)+".*.bin")
+	if err != nil {
+		return "", 0, err
+	}
+	tabFilePath := tmpFile.Name()
+	buff := bufio.NewWriter(tmpFile)
+	if err = u.writeShardKeys(buff, shardIdx, keys); err == nil {
+		err = buff.Flush()
+	}
+	if err != nil {
+		tmpFile.Close()
+		return tabFilePath, 0, err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return tabFilePath, 0, err
+	}
+
+	tblFile, err := os.Open(tabFilePath)
+	if err != nil {
+		return tabFilePath, 0, err
+	}
+	table, err := BuildFromFile(tblFile, u.base.keyLen)
+	if err != nil {
+		tblFile.Close()
+		return tabFilePath, 0, err
+	}
+	defer table.Close()
+	if err = table.DumpToKeysFile(); err != nil {
+		return tabFilePath, 0, err
+	}
+	return tabFilePath, uint(table.numKeys), nil
+}
+
+// checkNewKeys returns an error if any of keys is already in shard shardIdx
+// or appears twice in keys.
+func (u *ShardedUpdater) checkNewKeys(shardIdx uint64, keys [][]byte) error {
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[string(key)] {
+			return fmt.Errorf("key %x put twice", key)
+		}
+		seen[string(key)] = true
+	}
+	if u.base.counts[shardIdx] == 0 {
+		return nil
+	}
+	table, err := u.base.loadShard(shardIdx)
+	if err != nil {
+		return err
+	}
+	defer table.Close()
+	for _, key := range keys {
+		if _, ok := table.Lookup(key); ok {
+			return fmt.Errorf("key %x already present", key)
+		}
+	}
+	return nil
+}
+
+// writeShardKeys writes the existing keys of shard shardIdx, without their
+// footer, followed by keys to w.
+func (u *ShardedUpdater) writeShardKeys(w io.Writer, shardIdx uint64, keys [][]byte) error {
+	if cnt := u.base.counts[shardIdx]; cnt > 0 {
+		oldFile, err := os.Open(u.base.tabFilePaths[shardIdx])
+		if err != nil {
+			return err
+		}
+		defer oldFile.Close()
+		if _, err = io.CopyN(w, oldFile, int64(cnt)*int64(u.base.keyLen)); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		if _, err := w.Write(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close discards the keys put since the updater was created. It returns
+// ErrClosed if u is already closed.
+func (u *ShardedUpdater) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		return ErrClosed
+	}
+	u.closed = true
+	u.added = nil
+	return nil
+}
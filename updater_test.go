@@ -0,0 +1,194 @@
+package mph
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestShardedUpdater(t *testing.T) {
+	keys := sha1Keys(2000)
+	dir := t.TempDir()
+	mphDir := filepath.Join(dir, "shards")
+	st := buildShardedTable(t, mphDir, keys[:1500], 4)
+	manifestPath := filepath.Join(dir, "sharded.mph")
+	if err := st.DumpToFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	before := readShardFiles(t, mphDir)
+	old, err := LoadShardedTableFromFile(manifestPath, WithLazyLoading(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+
+	u, err := NewShardedUpdater(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := make(map[string]bool)
+	for _, key := range keys[1500:1503] {
+		if err = u.Put(key); err != nil {
+			t.Fatal(err)
+		}
+		shardIdx, _ := u.base.shardIndex(key)
+		changed[strconv.FormatUint(shardIdx, 10)+".bin"] = true
+	}
+	updated, err := u.Commit(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkShardedLookups(t, updated, keys[:1503])
+	if got := updated.NumKeys(); got != 1503 {
+		t.Errorf("NumKeys: got %d; want 1503", got)
+	}
+	updated.Close()
+	if _, err = u.Commit(context.Background(), 2); err != ErrCommitted {
+		t.Errorf("second Commit: got %v; want ErrCommitted", err)
+	}
+
+	// The old files are left for readers of the old manifest.
+	after := readShardFiles(t, mphDir)
+	for name, data := range before {
+		if !bytes.Equal(after[name], data) {
+			t.Errorf("keys file %s was modified", name)
+		}
+	}
+	if len(after) != len(before)+len(changed) {
+		t.Errorf("got %d keys files after update; want %d", len(after), len(before)+len(changed))
+	}
+	checkShardedLookups(t, old, keys[:1500])
+
+	garbage, err := CollectGarbage(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range garbage {
+		if !changed[filepath.Base(p)] {
+			t.Errorf("CollectGarbage removed %s, which is not an old keys file of a rebuilt shard", p)
+		}
+	}
+	if len(garbage) != len(changed) {
+		t.Errorf("CollectGarbage: got %v; want the old keys files of %d rebuilt shards", garbage, len(changed))
+	}
+
+	loaded, err := LoadShardedTableFromFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	checkShardedLookups(t, loaded, keys[:1503])
+
+	rep, err := Verify(manifestPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.OK() {
+		t.Errorf("Verify of the updated table: got %v; want no problems", rep.Problems)
+	}
+}
+
+func TestShardedUpdaterDuplicate(t *testing.T) {
+	keys := sha1Keys(1000)
+	dir := t.TempDir()
+	mphDir := filepath.Join(dir, "shards")
+	st := buildShardedTable(t, mphDir, keys[:900], 3)
+	manifestPath := filepath.Join(dir, "sharded.mph")
+	if err := st.DumpToFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	manifest, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := readShardFiles(t, mphDir)
+
+	for _, dups := range [][][]byte{
+		{keys[950], keys[0]},
+		{keys[950], keys[950]},
+	} {
+		u, err := NewShardedUpdater(manifestPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range dups {
+			if err = u.Put(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err = u.Commit(context.Background(), 0); err == nil {
+			t.Fatal("Commit with duplicate key: got nil error; want error")
+		}
+		got, err := os.ReadFile(manifestPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, manifest) {
+			t.Error("manifest changed by a failed Commit")
+		}
+		if after := readShardFiles(t, mphDir); len(after) != len(before) {
+			t.Errorf("got %d keys files after a failed Commit; want %d", len(after), len(before))
+		}
+	}
+}
+
+func TestShardedUpdaterConcurrent(t *testing.T) {
+	keys := sha1Keys(1000)
+	dir := t.TempDir()
+	st := buildShardedTable(t, filepath.Join(dir, "shards"), keys[:800], 3)
+	manifestPath := filepath.Join(dir, "sharded.mph")
+	if err := st.DumpToFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+
+	var us [2]*ShardedUpdater
+	for i := range us {
+		u, err := NewShardedUpdater(manifestPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys[800+100*i : 900+100*i] {
+			if err = u.Put(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		us[i] = u
+	}
+	updated, err := us[0].Commit(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated.Close()
+	if _, err = us[1].Commit(context.Background(), 0); err != ErrManifestChanged {
+		t.Fatalf("Commit of a stale updater: got %v; want ErrManifestChanged", err)
+	}
+	loaded, err := LoadShardedTableFromFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	checkShardedLookups(t, loaded, keys[:900])
+}
+
+func readShardFiles(t *testing.T, mphDir string) map[string][]byte {
+	t.Helper()
+	entries, err := os.ReadDir(mphDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(mphDir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = data
+	}
+	return files
+}
@@ -0,0 +1,291 @@
+package mph
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// A VerifyReport is the outcome of Verify.
+type VerifyReport struct {
+	Shards   int
+	Keys     uint64
+	Problems []ShardProblem // by shard
+}
+
+// OK reports whether no problem was found.
+func (rep *VerifyReport) OK() bool {
+	return len(rep.Problems) == 0
+}
+
+// A ShardProblem is the first problem that Verify found in a shard.
+type ShardProblem struct {
+	Shard int
+	Path  string // of the keys file, or of the bundle
+	Err   error
+}
+
+func (p ShardProblem) Error() string {
+	return fmt.Sprintf("shard %d (%s): %v", p.Shard, p.Path, p.Err)
+}
+
+// Verify checks the sharded table dumped to filePath, a manifest or a bundle,
+// without loading it. The manifest must be consistent: an error is returned
+// otherwise. Every non-empty shard is then checked for
+//
+//   - the length of its keys file, which must hold the keys counted by the
+//     manifest followed by exactly one footer
+//   - its footer, whose key length and count must match the manifest and
+//     whose tables must be well-formed
+//   - the checksum of its keys file, if the manifest records one
+//   - if lookups is set, a round trip of every key: it must be routed to the
+//     shard and found at its position in the keys file
+//
+// and the first problem found in every shard is reported. opts are used to
+// resolve the paths of the manifest, and WithLoadParallelism bounds the number
+// of shards checked at once.
+func Verify(filePath string, lookups bool, opts ...LoadOption) (*VerifyReport, error) {
+	lo := newLoadOptions(opts)
+	bundled, err := isBundle(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		m       *shardManifest
+		paths   []string
+		bundle  *os.File
+		regions []bundleRegion
+	)
+	if bundled {
+		if bundle, err = os.Open(filePath); err != nil {
+			return nil, err
+		}
+		defer bundle.Close()
+		hdr, err := readBundleHeader(bundle)
+		if err != nil {
+			return nil, err
+		}
+		m = &hdr.Manifest
+		if len(hdr.Regions) != len(m.Counts) {
+			return nil, fmt.Errorf("bundle has %d shard regions for %d shards", len(hdr.Regions), len(m.Counts))
+		}
+		regions = hdr.Regions
+		paths = make([]string, len(m.Counts))
+		for i := range paths {
+			paths[i] = filePath
+		}
+	} else {
+		if m, _, paths, err = openIndex(filePath, opts); err != nil {
+			return nil, err
+		}
+	}
+	r, err := newShardedReaderFromManifest(m)
+	if err != nil {
+		return nil, err
+	}
+	if r.keyLen < 1 {
+		return nil, fmt.Errorf("manifest has key length %d", r.keyLen)
+	}
+
+	rep := &VerifyReport{Shards: len(r.counts), Keys: r.NumKeys()}
+	var mu sync.Mutex // guards rep.Problems
+	var grp errgroup.Group
+	grp.SetLimit(lo.parallelism)
+	for i, cnt := range r.counts {
+		if cnt == 0 {
+			continue
+		}
+		grp.Go(func() error {
+			var region bundleRegion
+			if bundle != nil {
+				region = regions[i]
+			}
+			err := r.verifyShard(uint64(i), paths[i], bundle, region.Off, region.Len, lookups)
+			if err != nil {
+				mu.Lock()
+				rep.Problems = append(rep.Problems, ShardProblem{Shard: i, Path: paths[i], Err: err})
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	grp.Wait()
+	sort.Slice(rep.Problems, func(i, j int) bool {
+		return rep.Problems[i].Shard < rep.Problems[j].Shard
+	})
+	return rep, nil
+}
+
+// verifyShard checks shard shardIdx of r, read from the size bytes at off in
+// f if f is set, and from the keys file at path otherwise.
+func (r *ShardedReader) verifyShard(shardIdx uint64, path string, f *os.File, off, size int64, lookups bool) error {
+	if path == "" || (f != nil && size == 0) {
+		return fmt.Errorf("no keys file for %d keys", r.counts[shardIdx])
+	}
+	if f == nil {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return err
+		}
+		defer f.Close()
+		stats, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		size = stats.Size()
+	}
+	sr := io.NewSectionReader(f, off, size)
+
+	keysLen := int64(r.counts[shardIdx]) * int64(r.keyLen)
+	if size < keysLen+keysTrailerLen {
+		return fmt.Errorf(
+			"keys file holds %d bytes, too few for %d keys of %d bytes and a footer",
+			size,
+			r.counts[shardIdx],
+			r.keyLen,
+		)
+	}
+	keyLen, numKeys, ok, err := readKeysTrailer(sr, size)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("keys file has no footer")
+	}
+	if int(keyLen) != r.keyLen || uint(numKeys) != r.counts[shardIdx] {
+		return fmt.Errorf(
+			"footer has %d keys of %d bytes, manifest has %d keys of %d bytes",
+			numKeys,
+			keyLen,
+			r.counts[shardIdx],
+			r.keyLen,
+		)
+	}
+	if r.checksums != nil {
+		sum, err := checksum(io.NewSectionReader(f, off, size))
+		if err != nil {
+			return err
+		}
+		if sum != r.checksums[shardIdx] {
+			return fmt.Errorf("checksum is %08x, manifest has %08x", sum, r.checksums[shardIdx])
+		}
+	}
+
+	// The table reads its keys in place and must not close f.
+	t := Table{keysFile: f, keysOff: off, bundled: true, keyLen: int(keyLen), numKeys: int(numKeys)}
+	footerLen := size - keysTrailerLen - keysLen
+	if err = t.decodeLevels(io.NewSectionReader(sr, keysLen, footerLen)); err != nil {
+		return fmt.Errorf("corrupt footer: %v", err)
+	}
+	if err = t.checkLevels(); err != nil {
+		return fmt.Errorf("corrupt footer: %v", err)
+	}
+	var footer bytes.Buffer
+	if err = t.encodeLevels(&footer); err != nil {
+		return err
+	}
+	if int64(footer.Len()) != footerLen {
+		return fmt.Errorf(
+			"keys file holds %d bytes, expected %d for %d keys and the footer",
+			size,
+			keysLen+int64(footer.Len())+keysTrailerLen,
+			numKeys,
+		)
+	}
+	if !lookups {
+		return nil
+	}
+
+	keys := bufio.NewReader(io.NewSectionReader(sr, 0, keysLen))
+	key := make([]byte, keyLen)
+	for j := uint32(0); j < numKeys; j++ {
+		if _, err = io.ReadFull(keys, key); err != nil {
+			return err
+		}
+		if idx, err := r.shardIndex(key); err != nil {
+			return fmt.Errorf("key %d (%x): %v", j, key, err)
+		} else if idx != shardIdx {
+			return fmt.Errorf("key %d (%x) belongs to shard %d", j, key, idx)
+		}
+		if n, ok := t.Lookup(key); !ok || n != j {
+			return fmt.Errorf("key %d (%x) is not found at its index", j, key)
+		}
+	}
+	return nil
+}
+
+// checkLevels returns an error unless the hash tables of t are consistent
+// with each other and with its key count, so that lookups stay in bounds.
+func (t *Table) checkLevels() error {
+	if len(t.level0) == 0 || len(t.level0) != t.level0Mask+1 || len(t.level0)&t.level0Mask != 0 {
+		return fmt.Errorf("level 0 has %d entries and mask %#x", len(t.level0), t.level0Mask)
+	}
+	if len(t.level1) < t.numKeys || len(t.level1) != t.level1Mask+1 || len(t.level1)&t.level1Mask != 0 {
+		return fmt.Errorf("level 1 has %d entries and mask %#x for %d keys", len(t.level1), t.level1Mask, t.numKeys)
+	}
+	for _, n := range t.level1 {
+		if int(n) >= t.numKeys {
+			return fmt.Errorf("level 1 refers to key %d of %d", n, t.numKeys)
+		}
+	}
+	return nil
+}
+
+// fillChecksums computes the checksums of the shards of r, unless it already
+// has them.
+func (r *ShardedReader) fillChecksums() error {
+	if r.checksums != nil {
+		return nil
+	}
+	checksums := make([]uint32, len(r.counts))
+	var grp errgroup.Group
+	grp.SetLimit(runtime.GOMAXPROCS(0))
+	for i, cnt := range r.counts {
+		if cnt == 0 {
+			continue
+		}
+		grp.Go(func() error {
+			var err error
+			if r.bundleFile != nil {
+				region := r.bundleRegions[i]
+				checksums[i], err = checksum(io.NewSectionReader(r.bundleFile, region.Off, region.Len))
+			} else {
+				checksums[i], err = fileChecksum(r.tabFilePaths[i])
+			}
+			if err != nil {
+				return fmt.Errorf("shard %d: %v", i, err)
+			}
+			return nil
+		})
+	}
+	if err := grp.Wait(); err != nil {
+		return err
+	}
+	r.checksums = checksums
+	return nil
+}
+
+func fileChecksum(filePath string) (uint32, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return checksum(f)
+}
+
+func checksum(src io.Reader) (uint32, error) {
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, src); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
@@ -0,0 +1,85 @@
+package mph
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	keys := sha1Keys(2000)
+	mphDir := t.TempDir()
+	manifestPath := filepath.Join(mphDir, "sharded.mph")
+	st := buildShardedTable(t, mphDir, keys, 3)
+	if err := st.DumpToFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+	bundlePath := filepath.Join(t.TempDir(), "sharded.bundle")
+	if err := st.DumpToBundle(bundlePath); err != nil {
+		t.Fatal(err)
+	}
+	tabFilePaths := st.tabFilePaths
+	st.Close()
+
+	for _, filePath := range []string{manifestPath, bundlePath} {
+		rep, err := Verify(filePath, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rep.OK() || rep.Shards != 8 || rep.Keys != uint64(len(keys)) {
+			t.Errorf("Verify(%s): got %+v; want 8 sound shards of %d keys", filePath, rep, len(keys))
+		}
+	}
+
+	// Flip a bit of a key in shard 2 and truncate shard 5.
+	data, err := os.ReadFile(tabFilePaths[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[3] ^= 1
+	if err = os.WriteFile(tabFilePaths[2], data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(tabFilePaths[5], 100); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := Verify(manifestPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Problems) != 2 || rep.Problems[0].Shard != 2 || rep.Problems[1].Shard != 5 {
+		t.Fatalf("Verify of corrupt shards: got %v; want problems in shards 2 and 5", rep.Problems)
+	}
+	if !strings.Contains(rep.Problems[0].Error(), "checksum") {
+		t.Errorf("shard 2: got %v; want a checksum mismatch", rep.Problems[0])
+	}
+
+	// Without checksums, only the lookups find the flipped bit.
+	m, err := readManifest(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Checksums = nil
+	if err = writeManifest(manifestPath, m); err != nil {
+		t.Fatal(err)
+	}
+	for _, lookups := range []bool{false, true} {
+		rep, err = Verify(manifestPath, lookups)
+		if err != nil {
+			t.Fatal(err)
+		}
+		corrupt := len(rep.Problems) > 0 && rep.Problems[0].Shard == 2
+		if corrupt != lookups {
+			t.Errorf("Verify with lookups %v: got %v", lookups, rep.Problems)
+		}
+	}
+
+	m.TabFilePaths = m.TabFilePaths[1:]
+	if err = writeManifest(manifestPath, m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Verify(manifestPath, false); err == nil {
+		t.Error("Verify with misaligned shard paths: got nil error; want error")
+	}
+}